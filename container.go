@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+	"github.com/dpvpro/deber/pkg/steps"
+	"github.com/spf13/cobra"
+	"pault.ag/go/debian/changelog"
+)
+
+// newContainerCommand returns command managing container
+// of package in current directory.
+func newContainerCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "container",
+		Short: "Manage container of package in current directory",
+		Long: `Manage container of package in current directory, built for target
+distribution from debian/changelog or the one given with --target-dist.`,
+	}
+
+	tail := ""
+
+	logs := &cobra.Command{
+		Use:   "logs",
+		Short: "Show logs of container",
+		RunE: withContainer(func(dock docker.Engine, n *naming.Naming) error {
+			return dock.ContainerLogs(n.Container, tail, log.Output, os.Stderr)
+		}),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	logs.Flags().StringVar(&tail, "tail", "100", "number of lines to show from the end of logs, or all")
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:           "inspect",
+			Short:         "Show state and mounts of container",
+			RunE:          withContainer(inspectContainer),
+			SilenceUsage:  true,
+			SilenceErrors: true,
+		},
+		&cobra.Command{
+			Use:   "rm",
+			Short: "Stop and remove container",
+			RunE: withContainer(func(dock docker.Engine, n *naming.Naming) error {
+				err := steps.Stop(dock, n)
+				if err != nil {
+					return err
+				}
+				return steps.Remove(dock, n, *keepVolumes)
+			}),
+			SilenceUsage:  true,
+			SilenceErrors: true,
+		},
+		logs,
+	)
+
+	return cmd
+}
+
+// withContainer returns command function resolving container
+// of package in current directory and failing if there is none.
+func withContainer(fn func(dock docker.Engine, n *naming.Naming) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		dock, err := docker.New(docker.Args{Engine: *engine, Stdout: log.Output})
+		if err != nil {
+			return err
+		}
+
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+
+		resolveDirs()
+
+		ch, err := changelog.ParseFileOne(filepath.Join(cwd, "debian/changelog"))
+		if err != nil {
+			return err
+		}
+
+		target := *targetDist
+		if target == "" {
+			target = ch.Target
+		}
+
+		n := newNaming(ch, cwd, target)
+
+		isContainerCreated, err := dock.IsContainerCreated(n.Container)
+		if err != nil {
+			return err
+		}
+		if !isContainerCreated {
+			return fmt.Errorf("container %s doesn't exist", n.Container)
+		}
+
+		return fn(dock, n)
+	}
+}
+
+// inspectContainer prints state and mounts of container.
+func inspectContainer(dock docker.Engine, n *naming.Naming) error {
+	isContainerStarted, err := dock.IsContainerStarted(n.Container)
+	if err != nil {
+		return err
+	}
+
+	state := "stopped"
+	if isContainerStarted {
+		state = "running"
+	}
+
+	mounts, err := dock.ContainerMounts(n.Container)
+	if err != nil {
+		return err
+	}
+
+	labels, err := dock.ContainerLabels(n.Container)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(log.Output, "Name:   %s\n", n.Container)
+	fmt.Fprintf(log.Output, "Image:  %s\n", n.Image)
+	fmt.Fprintf(log.Output, "State:  %s\n", state)
+	fmt.Fprintf(log.Output, "Source: %s\n", labels[steps.LabelSource])
+	fmt.Fprintln(log.Output, "Mounts:")
+
+	writer := tabwriter.NewWriter(log.Output, 0, 0, 2, ' ', 0)
+	for _, mnt := range mounts {
+		mode := "rw"
+		if mnt.ReadOnly {
+			mode = "ro"
+		}
+		fmt.Fprintf(writer, "  %s\t%s\t%s\t%s\n", mnt.Type, mnt.Source, mnt.Target, mode)
+	}
+
+	return writer.Flush()
+}
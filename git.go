@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpvpro/deber/pkg/log"
+)
+
+// gitWorktree checks out given ref of git repository in dir
+// to a clean worktree next to it, and returns its path along
+// with function removing it.
+//
+// Worktree is a sibling of repository, so upstream tarballs
+// are found in the same parent directory.
+func gitWorktree(dir, ref string) (string, func(), error) {
+	output, err := exec.Command("git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("%s is not a git repository", dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.TrimSpace(string(output)) != resolved {
+		return "", nil, fmt.Errorf("%s is not top level directory of git repository", dir)
+	}
+
+	err = exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}").Run()
+	if err != nil {
+		return "", nil, fmt.Errorf("git ref %s doesn't exist", ref)
+	}
+
+	worktree := filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+"-"+Program+"-worktree")
+
+	// Leftover of interrupted run
+	if _, err := os.Stat(worktree); err == nil {
+		err = removeGitWorktree(dir, worktree)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	cmd := exec.Command("git", "-C", dir, "worktree", "add", "--detach", worktree, ref)
+	cmd.Stdout = log.Output
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", nil, fmt.Errorf("git worktree add: %w", err)
+	}
+
+	remove := func() {
+		err := removeGitWorktree(dir, worktree)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	return worktree, remove, nil
+}
+
+// removeGitWorktree removes worktree of repository in dir.
+func removeGitWorktree(dir, worktree string) error {
+	output, err := exec.Command("git", "-C", dir, "worktree", "remove", "--force", worktree).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git worktree remove: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
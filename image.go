@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/dockerfile"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/steps"
+	"github.com/spf13/cobra"
+)
+
+// newImageCommand returns command moving images
+// between hosts as tarballs.
+func newImageCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "image",
+		Short: "Save and load images as tarballs",
+		Long: `Save images to tarball and load them back, like on another host,
+so they don't have to be built again there. Useful to cache images
+in CI without registry.`,
+	}
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "save FILE [TARGET ...]",
+			Short: "Save images of all (or given) targets to tarball",
+			Args:  cobra.MinimumNArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				dock, err := newImageDocker()
+				if err != nil {
+					return err
+				}
+
+				names := make([]string, 0)
+				for _, target := range args[1:] {
+					names = append(names, *prefix+":"+target)
+				}
+				if len(names) == 0 {
+					names, err = dock.ImageList(*prefix + ":")
+					if err != nil {
+						return err
+					}
+				}
+
+				return steps.SaveImages(dock, names, args[0])
+			},
+			SilenceUsage:  true,
+			SilenceErrors: true,
+		},
+		&cobra.Command{
+			Use:   "load FILE",
+			Short: "Load images from tarball",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				dock, err := newImageDocker()
+				if err != nil {
+					return err
+				}
+
+				mirrors, err := imageMirrors()
+				if err != nil {
+					return err
+				}
+
+				packages, err := dockerfile.ImagePackages(*imagePackages)
+				if err != nil {
+					return err
+				}
+
+				return steps.LoadImages(dock, args[0], *age, mirrors, packages)
+			},
+			SilenceUsage:  true,
+			SilenceErrors: true,
+		},
+	)
+
+	return cmd
+}
+
+// newImageDocker connects to Docker Engine for image commands.
+func newImageDocker() (docker.Engine, error) {
+	dock, err := docker.New(docker.Args{Engine: *engine, Stdout: log.Output})
+	if err != nil {
+		return nil, err
+	}
+
+	return dock, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+// signIndex is the key Release files are signed with, if any
+var signIndex string
+
+// newIndexCommand returns command generating apt indices of archive.
+func newIndexCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "index [TARGET ...]",
+		Short: "Generate Packages, Sources and Release indices of archive",
+		Long: `Generate Packages, Sources and Release indices for every target
+distribution in archive (or only given ones), so it can be used as apt source:
+
+  deb [trusted=yes] file:///tmp/deber/packages/unstable ./
+  deb-src [trusted=yes] file:///tmp/deber/packages/unstable ./
+
+With --sign-index, Release is signed with given key by gpg on host,
+into Release.gpg and InRelease, so archive can be trusted by its key:
+
+  deb [signed-by=/path/to/key.gpg] file:///tmp/deber/packages/unstable ./
+
+Requires dpkg-scanpackages and dpkg-scansources (dpkg-dev) on host.`,
+		RunE:          runIndex,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.Flags().StringVar(&signIndex, "sign-index", "", "sign Release with given gpg key")
+
+	return cmd
+}
+
+func runIndex(cmd *cobra.Command, args []string) error {
+	resolveDirs()
+
+	if signIndex != "" {
+		err := checkSecretKey(signIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	targets := args
+	if len(targets) == 0 {
+		entries, err := os.ReadDir(packagesDir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				targets = append(targets, entry.Name())
+			}
+		}
+	}
+
+	for _, target := range targets {
+		err := index(filepath.Join(packagesDir, target), signIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// index generates Packages, Sources and Release files
+// in archive directory of single target, and signs Release
+// if key is given.
+//
+// Signatures left from previous run are removed otherwise,
+// as they no longer match Release.
+func index(dir, key string) error {
+	log.Info(fmt.Sprintf("Indexing %s", filepath.Base(dir)))
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return log.Failed(err)
+	}
+	if !info.IsDir() {
+		return log.Failed(fmt.Errorf("%s is not a directory", dir))
+	}
+
+	indices := map[string][]string{
+		"Packages": {"dpkg-scanpackages", "--multiversion", "."},
+		"Sources":  {"dpkg-scansources", "."},
+	}
+
+	for _, name := range []string{"Packages", "Sources"} {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return log.Failed(err)
+		}
+
+		command := exec.Command(indices[name][0], indices[name][1:]...)
+		command.Dir = dir
+		command.Stdout = file
+
+		output := new(strings.Builder)
+		command.Stderr = output
+
+		err = command.Run()
+		if err != nil {
+			file.Close()
+			return log.Failed(fmt.Errorf("%s: %w: %s", indices[name][0], err, strings.TrimSpace(output.String())))
+		}
+
+		err = file.Close()
+		if err != nil {
+			return log.Failed(err)
+		}
+	}
+
+	release, err := releaseFile(dir, []string{"Packages", "Sources"})
+	if err != nil {
+		return log.Failed(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "Release"), release, 0644)
+	if err != nil {
+		return log.Failed(err)
+	}
+
+	signatures := map[string][]string{
+		"Release.gpg": {"--armor", "--detach-sign"},
+		"InRelease":   {"--clearsign"},
+	}
+
+	for _, name := range []string{"Release.gpg", "InRelease"} {
+		path := filepath.Join(dir, name)
+
+		if key == "" {
+			err = os.Remove(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return log.Failed(err)
+			}
+			continue
+		}
+
+		args := append([]string{"--batch", "--yes", "--local-user", key, "--output", path}, signatures[name]...)
+		output, err := exec.Command("gpg", append(args, filepath.Join(dir, "Release"))...).CombinedOutput()
+		if err != nil {
+			return log.Failed(fmt.Errorf("gpg: %w: %s", err, strings.TrimSpace(string(output))))
+		}
+	}
+
+	return log.Done()
+}
+
+// releaseFile returns content of Release file
+// listing checksums of given indices in directory.
+func releaseFile(dir string, indices []string) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "Date: %s\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintln(buffer, "SHA256:")
+
+	for _, name := range indices {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(buffer, " %x %d %s\n", sha256.Sum256(content), len(content), name)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// checkSecretKey returns error if there's no secret key
+// of given ID in host's keyring.
+func checkSecretKey(key string) error {
+	err := exec.Command("gpg", "--batch", "--list-secret-keys", "--", key).Run()
+	if err != nil {
+		return fmt.Errorf("secret key %s not available: %w", key, err)
+	}
+
+	return nil
+}
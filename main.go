@@ -1,15 +1,29 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	units "github.com/docker/go-units"
+	"github.com/dpvpro/deber/pkg/config"
+	"github.com/dpvpro/deber/pkg/control"
 	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/dockerfile"
+	"github.com/dpvpro/deber/pkg/dockerhub"
+	"github.com/dpvpro/deber/pkg/lintian"
 	"github.com/dpvpro/deber/pkg/log"
 	"github.com/dpvpro/deber/pkg/naming"
 	"github.com/dpvpro/deber/pkg/steps"
+	"github.com/dpvpro/deber/pkg/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"pault.ag/go/debian/changelog"
@@ -22,34 +36,158 @@ const (
 	Version = "1.5.4"
 	// Description of program
 	Description = "Debian packaging with Docker"
+
+	// ppaDpkgFlags are dpkg-buildpackage flags producing source-only
+	// upload for Launchpad PPA, always including orig tarball
+	ppaDpkgFlags = "-S -sa -us -uc -tc"
+
+	// defaultMirror is the mirror official packages are
+	// downloaded from, if none is given to --compare-with-archive
+	defaultMirror = "https://deb.debian.org/debian"
 )
 
 var (
-	buildDir     = pflag.StringP("build-dir", "B", "", "where to place build stuff")
-	cacheDir     = pflag.StringP("cache-dir", "C", "", "where to place cached stuff")
-	systemDir    = pflag.StringP("system-dir", "S", "", "system directory for deber")
-	targetDist   = pflag.StringP("target-dist", "T", "", "override target distribution")
-	dpkgFlags    = pflag.StringP("dpkg-flags", "D", "-b -uc -tc", "additional flags to be passed to dpkg-buildpackage in container")
-	lintianFlags = pflag.StringP("lintian-flags", "L", "-i -I", "additional flags to be passed to lintian in container")
-	packages     = pflag.StringArrayP("package", "P", nil, "additional packages to be installed in container (either single .deb or a directory)")
-	age          = pflag.DurationP("age", "a", time.Hour*24*7, "time after which image will be refreshed")
-	network      = pflag.BoolP("network", "n", false, "allow network access during package build")
-	shell        = pflag.BoolP("shell", "s", false, "launch interactive shell in container")
-	lintian      = pflag.BoolP("lintian", "l", false, "run lintian in container")
-	tests        = pflag.BoolP("tests", "t", false, "do not test when building package")
-	noLogColor   = pflag.BoolP("no-log-color", "", false, "do not colorize log output")
-	noRemove     = pflag.BoolP("no-remove", "", false, "do not remove container at the end of the process")
-
-	packagesDir string
-	sourcesDir  string
+	buildDir          = pflag.StringP("build-dir", "B", "", "where to place build stuff")
+	cacheDir          = pflag.StringP("cache-dir", "C", "", "where to place cached stuff")
+	systemDir         = pflag.StringP("system-dir", "S", "", "system directory for deber")
+	targetDist        = pflag.StringP("target-dist", "T", "", "override target distribution")
+	dpkgFlags         = pflag.StringP("dpkg-flags", "D", "-b -uc -tc", "additional flags to be passed to dpkg-buildpackage in container")
+	lintianFlags      = pflag.StringP("lintian-flags", "L", "-i -I", "additional flags to be passed to lintian in container")
+	packages          = pflag.StringArrayP("package", "P", nil, "additional packages to be installed in container (either single .deb or a directory)")
+	age               = pflag.DurationP("age", "a", time.Hour*24*7, "time after which image will be refreshed")
+	network           = pflag.BoolP("network", "n", false, "allow network access during package build")
+	shell             = pflag.BoolP("shell", "s", false, "launch interactive shell in container")
+	lint              = pflag.BoolP("lintian", "l", false, "run lintian in container")
+	tests             = pflag.BoolP("tests", "t", false, "do not test when building package")
+	noLogColor        = pflag.BoolP("no-log-color", "", false, "do not colorize log output")
+	noRemove          = pflag.BoolP("no-remove", "", false, "do not remove container at the end of the process")
+	recommends        = pflag.BoolP("install-recommends", "", false, "install recommended packages along with build dependencies")
+	sourcesList       = pflag.StringP("sources-list", "", "", "apt sources list file to use in container instead of the default one")
+	keepVolumes       = pflag.BoolP("keep-volumes", "", false, "do not remove anonymous volumes along with container")
+	minFreeSpace      = pflag.StringP("min-free-space", "", "1g", "minimum free space required in deber directories, 0 to skip the check")
+	profiles          = pflag.StringP("profiles", "", "", "comma separated build profiles, overrides ones mapped to target distribution")
+	targetDists       = pflag.StringSliceP("targets", "", nil, "comma separated target distributions to build package for")
+	jobs              = pflag.IntP("jobs", "j", 1, "how many targets can be built at the same time")
+	targetProfs       = pflag.StringArrayP("target-profiles", "", nil, "build profiles to use by default for target distribution (TARGET=PROFILE[,PROFILE...])")
+	changesDist       = pflag.StringP("changes-distribution", "", "", "override distribution in .changes file, target distribution stays intact")
+	changesUrgency    = pflag.StringP("changes-urgency", "", "", "override urgency in .changes file (low, medium, high, emergency or critical)")
+	imageFrom         = pflag.StringP("image-from", "", steps.ImageFromDockerHub, "where to get parent image from (dockerhub or debootstrap, which requires root)")
+	recordDeps        = pflag.StringP("record-deps", "", "", "record versions of packages installed in container to file")
+	replayDeps        = pflag.StringP("replay-deps", "", "", "pin versions of packages recorded in file when installing dependencies")
+	lintianFailOn     = pflag.StringP("lintian-fail-on", "", lintian.SeverityError, "lowest severity of lintian tags that fails the build (E, W or I)")
+	gpgAgent          = pflag.BoolP("gpg-agent", "", false, "sign package in container using host's gpg agent")
+	validate          = pflag.StringP("validate", "", "", "script to run in source directory in container before building package")
+	freshLists        = pflag.BoolP("fresh-lists", "", false, "download apt package lists from scratch, keeping downloaded packages")
+	ppa               = pflag.BoolP("ppa", "", false, "build source-only package for Launchpad PPA upload using Ubuntu image")
+	stopAfter         = pflag.StringP("stop-after", "", "", "stop after given step (build, create, start, tarball, depends, validate, package, sign, lint, compare, archive or upload)")
+	startFrom         = pflag.StringP("start-from", "", "", "start from given step, assuming earlier ones are done")
+	hostname          = pflag.StringP("hostname", "", "", "hostname of container")
+	dns               = pflag.StringSliceP("dns", "", nil, "comma separated DNS servers used by container")
+	lintianSplit      = pflag.BoolP("lintian-split", "", false, "run lintian separately for source and binary packages")
+	lintianNoUdeb     = pflag.BoolP("lintian-no-udeb", "", false, "do not run lintian on installer packages (udebs)")
+	snapshotOnFailure = pflag.StringP("snapshot-on-failure", "", "", "export container filesystem to tarball (or directory) if build fails")
+	indep             = pflag.BoolP("indep-only", "", false, "build and lint only architecture independent packages (Architecture: all)")
+	retries           = pflag.IntP("retries", "", 0, "how many times to retry build failed because of network or apt problems")
+	compareMirror     = pflag.StringP("compare-with-archive", "", "", "compare built packages with official ones downloaded from given mirror")
+	diffoscope        = pflag.StringP("diffoscope", "", "", "write HTML report of diffoscope comparing build with previously archived one to given path")
+	prefix            = pflag.StringP("prefix", "", Program, "prefix of image and container names")
+	aptPin            = pflag.StringP("apt-pin", "", "", "apt preferences file used when installing dependencies")
+	metricsFile       = pflag.StringP("metrics-file", "", "", "write step durations and build results to file in Prometheus textfile format")
+	withLocal         = pflag.StringArrayP("with-local", "", nil, "directory with locally built packages to be installed in place of archive ones")
+	locale            = pflag.StringP("locale", "", "C.UTF-8", "locale to build package under, generated in container if needed")
+	sourceRO          = pflag.BoolP("source-ro", "", false, "mount source read-only, with writable copy of debian directory")
+	recursive         = pflag.StringP("recursive", "", "", "build all source packages found under given directory, in order of their build dependencies")
+	verifyTarball     = pflag.BoolP("verify-tarball", "", false, "verify signature of upstream tarball with debian/upstream/signing-key.asc")
+	signKey           = pflag.StringP("sign-key", "", "", "key to sign package with, defaults to one matching changelog maintainer")
+	sign              = pflag.BoolP("sign", "g", false, "sign built packages with debsign in container using host's gpg agent")
+	upload            = pflag.StringP("upload", "", "", "upload archived packages with dput on host to given target")
+	uploadConfig      = pflag.StringP("upload-config", "", "", "dput configuration file used for uploading, instead of default ones")
+	logFile           = pflag.StringP("log-file", "", "", "also write log, along with output of commands, to given file")
+	tmpDir            = pflag.StringP("tmpdir", "", "", "temporary directory of build in container (TMPDIR)")
+	tmpDirFrom        = pflag.StringP("tmpdir-from", "", "", "what backs temporary directory, tmpfs or host directory")
+	umask             = pflag.StringP("umask", "", "", "umask of build process and archived files (octal, like 0022)")
+	seedPackages      = pflag.StringP("seed-packages", "", "", "file listing packages to download to cache along with dependencies, for following builds")
+	labels            = pflag.StringArrayP("label", "", nil, "label of image and container (KEY=VALUE)")
+	execShell         = pflag.StringP("exec-shell", "", "bash", "shell executing commands in container, and launched by --shell")
+	initProcess       = pflag.BoolP("init", "", false, "run init as PID 1 in container, reaping zombies of daemons spawned by build")
+	copySource        = pflag.BoolP("copy-source", "", false, "build from copy of source made in build directory, leaving source intact")
+	copySourceIgnore  = pflag.StringSliceP("copy-source-ignore", "", []string{".git", ".pc", "debian/.debhelper", "debian/tmp"}, "comma separated patterns of files not copied with --copy-source")
+	lintianJSON       = pflag.StringP("report-lintian-json", "", "", "write lintian tags to given file as JSON array")
+	stepTimeouts      = pflag.StringSliceP("step-timeouts", "", nil, "comma separated timeouts of steps (STEP=DURATION), like package=1h,lint=10m")
+	tarballCompress   = pflag.StringSliceP("tarball-compression", "", []string{"xz", "gz", "bz2"}, "comma separated compressions of upstream tarball, in order of preference if there are several")
+	offline           = pflag.BoolP("offline", "", false, "use existing image regardless of its age, without querying DockerHub")
+	testOnly          = pflag.BoolP("test-only", "", false, "only build and test software, without making, linting and archiving packages")
+	provenanceFile    = pflag.StringP("provenance", "", "", "write provenance of successful builds (images, flags, commit, artifact checksums) to file as JSON")
+	addHosts          = pflag.StringArrayP("add-host", "", nil, "static host mapping added to /etc/hosts of container (NAME:IP)")
+	upgrade           = pflag.BoolP("upgrade", "", false, "upgrade packages in container to latest versions before installing dependencies")
+	tarballPath       = pflag.StringP("tarball", "", "", "orig upstream tarball to use, instead of searching for one")
+	lintianAllow      = pflag.StringSliceP("lintian-allow", "", nil, "comma separated lintian tags that never fail the build")
+	cacheGo           = pflag.BoolP("cache-go", "", false, "keep Go module cache on host between builds (GOMODCACHE)")
+	cacheCargo        = pflag.BoolP("cache-cargo", "", false, "keep Cargo home on host between builds (CARGO_HOME)")
+	cacheNpm          = pflag.BoolP("cache-npm", "", false, "keep npm cache on host between builds")
+	summaryJSON       = pflag.StringP("summary-json", "", "", "write result of the run to file as JSON, - for standard output")
+	snapshot          = pflag.StringP("snapshot", "", "", "install dependencies from snapshot.debian.org archive at given timestamp (like 20240101T000000Z)")
+	maxDownloads      = pflag.IntP("max-parallel-downloads", "", 0, "1 serializes apt downloads, more allows that many requests per host in flight, 0 leaves apt defaults")
+	gitRef            = pflag.StringP("git-ref", "", "", "build given git ref (branch, tag or commit) checked out to temporary worktree, leaving source untouched")
+	onlyPackages      = pflag.StringSliceP("only-packages", "", nil, "comma separated binary packages to build, others are skipped (debhelper only, not for upload)")
+	lockDeps          = pflag.BoolP("lock-deps", "", false, "archive lockfile of package versions installed in container along with packages")
+	noNetworkDeps     = pflag.BoolP("no-network-deps", "", false, "install build dependencies from apt cache only, without network access")
+	stopTimeout       = pflag.DurationP("stop-timeout", "", docker.ContainerStopTimeout, "how long container is given to stop before it's killed")
+	buildTimeout      = pflag.DurationP("timeout", "", 0, "time limit of build for each target, after which it's cancelled and container is removed")
+	verifyArch        = pflag.BoolP("verify-arch", "", false, "verify built binary packages are for architecture of the build")
+	resolver          = pflag.StringP("resolver", "", steps.ResolverApt, "build dependencies resolver (apt, aptitude or apt-cudf)")
+	trace             = pflag.BoolP("trace", "", false, "run dpkg-buildpackage under strace, writing trace to build directory")
+	traceOptions      = pflag.StringP("trace-options", "", steps.TraceOptions, "options passed to strace")
+	mirror            = pflag.StringP("mirror", "", "", "apt mirror used in image, serving Debian and Ubuntu archives as /debian and /ubuntu")
+	debianMirror      = pflag.StringP("debian-mirror", "", "", "apt mirror of Debian archive used in Debian images, overrides --mirror")
+	ubuntuMirror      = pflag.StringP("ubuntu-mirror", "", "", "apt mirror of Ubuntu archive used in Ubuntu images, overrides --mirror")
+	keepGoing         = pflag.BoolP("keep-going", "k", false, "keep building remaining targets after one fails")
+	containerRuntime  = pflag.StringP("runtime", "", "", "container runtime, like runsc (gVisor) or kata, Docker Engine's default if empty")
+	imageCache        = pflag.StringP("image-cache", "", "", "registry repository images are pulled from and pushed to, tagged with their content hash")
+	rootless          = pflag.BoolP("rootless", "", false, "build as root of container, mapped to you by rootless container engine")
+	memory            = pflag.StringP("memory", "", "", "memory limit of container, like 2g")
+	cpus              = pflag.StringP("cpus", "", "", "number of CPUs container can use, like 1.5")
+	configFile        = pflag.StringP("config", "", "", "configuration file with defaults of flags (default $XDG_CONFIG_HOME/deber/config.yaml)")
+	engine            = pflag.StringP("engine", "", "", "container engine, docker or podman, detected if empty")
+	arch              = pflag.StringP("arch", "A", "", "architecture to build package for, in image built for it, host one if empty")
+	imagePackages     = pflag.StringSliceP("image-packages", "", nil, "packages installed in image besides default ones, those prefixed with - are removed from defaults")
+
+	packagesDir  string
+	sourcesDir   string
+	languagesDir string
+	repos        = []string{"debian", "ubuntu"}
+	// localSources are source packages built earlier, whose
+	// archived packages are preferred when installing dependencies
+	localSources []string
+	// signingKey is the key package is signed with
+	signingKey string
+	// logFileHandle is the file log is also written to
+	logFileHandle *os.File
+	// userConfig holds defaults of flags from configuration file
+	userConfig = &config.Config{Flags: map[string][]string{}}
+
+	profileRegexp      = regexp.MustCompile(`^[a-z0-9.-]+$`)
+	distributionRegexp = regexp.MustCompile(`^[a-zA-Z0-9.+-]+$`)
+	prefixRegexp       = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+	mirrorRegexp       = regexp.MustCompile(`^https?://[a-zA-Z0-9._~:/%+-]+$`)
+	repositoryRegexp   = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-][a-z0-9]+)*)+$`)
+	urgencies          = []string{"low", "medium", "high", "emergency", "critical"}
+
+	// packageConfigFlags are flags that can be set in debian/deber.conf
+	packageConfigFlags = []string{"dpkg-flags", "lintian-flags", "package", "profiles", "step-timeouts"}
 )
 
+func init() {
+	pflag.Lookup("compare-with-archive").NoOptDefVal = defaultMirror
+}
+
 func main() {
 
 	cmd := &cobra.Command{
 		Use:                   fmt.Sprintf("%s [FLAGS ...]", Program),
 		Short:                 Description,
 		Version:               Version,
+		PersistentPreRunE:     setup,
 		RunE:                  run,
 		SilenceUsage:          true,
 		SilenceErrors:         true,
@@ -57,143 +195,696 @@ func main() {
 		DisableFlagsInUseLine: true,
 	}
 
-	err := cmd.Execute()
+	cmd.AddCommand(newIndexCommand(), newContainerCommand(), newRulesCommand(), newImageCommand())
+
+	err := loadConfig(os.Args[1:])
+	if err == nil {
+		err = cmd.Execute()
+	}
 	if err != nil {
 		log.Error(err)
+	}
+
+	if logFileHandle != nil {
+		logFileHandle.Close()
+	}
+
+	if err != nil {
 		os.Exit(1)
 	}
 
 }
 
-func run(cmd *cobra.Command, args []string) error {
+// setup configures logging before any command is run.
+func setup(cmd *cobra.Command, args []string) error {
 	log.NoColor = *noLogColor
 
-	dock, err := docker.New()
+	// Keep standard output clean for summary
+	if *summaryJSON == summaryOutput {
+		log.Output = os.Stderr
+	}
+
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		logFileHandle = file
+		log.Tee(file)
+	}
+
+	return nil
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	if strings.TrimSpace(*execShell) == "" || strings.ContainsAny(*execShell, " \t") {
+		return fmt.Errorf("invalid exec shell: %q", *execShell)
+	}
+
+	if *buildTimeout < 0 {
+		return fmt.Errorf("invalid build timeout: %s", *buildTimeout)
+	}
+	if *stopTimeout < 0 {
+		return fmt.Errorf("invalid stop timeout: %s", *stopTimeout)
+	}
+
+	dock, err := docker.New(docker.Args{
+		Engine:      *engine,
+		Stdout:      log.Output,
+		Shell:       *execShell,
+		StopTimeout: *stopTimeout,
+	})
 	if err != nil {
 		return err
 	}
 
+	if *changesDist != "" && !distributionRegexp.MatchString(*changesDist) {
+		return fmt.Errorf("invalid .changes distribution: %s", *changesDist)
+	}
+	if *changesUrgency != "" && !slices.Contains(urgencies, *changesUrgency) {
+		return fmt.Errorf("invalid .changes urgency: %s", *changesUrgency)
+	}
+
+	if !prefixRegexp.MatchString(*prefix) {
+		return fmt.Errorf("invalid prefix: %s", *prefix)
+	}
+
+	if *stopAfter != "" && !slices.Contains(stepOrder, *stopAfter) {
+		return fmt.Errorf("unknown step: %s", *stopAfter)
+	}
+	if *startFrom != "" && !slices.Contains(stepOrder, *startFrom) {
+		return fmt.Errorf("unknown step: %s", *startFrom)
+	}
+	if *startFrom != "" && *stopAfter != "" && slices.Index(stepOrder, *startFrom) > slices.Index(stepOrder, *stopAfter) {
+		return errors.New("--start-from step comes after --stop-after step")
+	}
+
+	if *testOnly && *startFrom != "" && slices.Index(stepOrder, *startFrom) > slices.Index(stepOrder, stepPackage) {
+		return errors.New("--test-only stops after package step")
+	}
+
+	if _, err := time.Parse(steps.SnapshotFormat, *snapshot); *snapshot != "" && err != nil {
+		return fmt.Errorf("invalid snapshot timestamp, expected like 20240101T000000Z: %s", *snapshot)
+	}
+	if *snapshot != "" && *sourcesList != "" {
+		return errors.New("--snapshot and --sources-list are mutually exclusive")
+	}
+	if *snapshot != "" && *ppa {
+		return errors.New("--snapshot serves Debian archive only, it can't be used with --ppa")
+	}
+
+	if *gitRef != "" && *recursive != "" {
+		return errors.New("--git-ref and --recursive are mutually exclusive")
+	}
+
+	if *tarballPath != "" && *recursive != "" {
+		return errors.New("--tarball and --recursive are mutually exclusive")
+	}
+
+	if *imageCache != "" && !repositoryRegexp.MatchString(*imageCache) {
+		return fmt.Errorf("invalid image cache repository: %s", *imageCache)
+	}
+
+	if foreignArch() != "" {
+		_, err := dockerhub.Platform(*arch)
+		if err != nil {
+			return fmt.Errorf("invalid architecture: %w", err)
+		}
+	}
+
+	if *copySource && *sourceRO {
+		return errors.New("--copy-source and --source-ro are mutually exclusive")
+	}
+
+	if *tmpDirFrom != "" && *tmpDir == "" {
+		return errors.New("--tmpdir-from requires --tmpdir")
+	}
+
+	for _, dir := range *withLocal {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
 
-	if *systemDir == "" {
-		*systemDir = filepath.Join(os.TempDir(), Program)
+	resolveDirs()
+
+	err = createDirs(*systemDir, *buildDir, *cacheDir, packagesDir, sourcesDir)
+	if err != nil {
+		return err
 	}
 
-	if *buildDir == "" {
-		*buildDir = filepath.Join(*systemDir, "builddir")
+	err = checkFreeSpace(*minFreeSpace, *systemDir, *buildDir, *cacheDir)
+	if err != nil {
+		return err
 	}
 
-	if *cacheDir == "" {
-		*cacheDir = filepath.Join(*systemDir, "cachedir")
+	if *metricsFile != "" {
+		defer func() {
+			errMetrics := writeMetrics(*metricsFile)
+			if errMetrics != nil {
+				log.Error(errMetrics)
+			}
+		}()
 	}
 
-	packagesDir = filepath.Join(*systemDir, "packages")
-	sourcesDir = filepath.Join(*systemDir, "sources")
+	if *provenanceFile != "" {
+		defer func() {
+			errProvenance := writeProvenance(*provenanceFile)
+			if errProvenance != nil {
+				log.Error(errProvenance)
+			}
+		}()
+	}
 
-	err = createDirs(*systemDir, *buildDir, *cacheDir, packagesDir, sourcesDir)
+	if *summaryJSON != "" {
+		defer func() {
+			errSummary := writeSummary(*summaryJSON)
+			if errSummary != nil {
+				log.Error(errSummary)
+			}
+		}()
+	}
+
+	if *recursive != "" {
+		return buildRecursive(dock, *recursive)
+	}
+
+	if *gitRef != "" {
+		worktree, remove, err := gitWorktree(cwd, *gitRef)
+		if err != nil {
+			return err
+		}
+		defer remove()
+
+		return buildSource(dock, worktree)
+	}
+
+	return buildSource(dock, cwd)
+}
+
+// buildSource runs pipeline for source package in given
+// directory, for every target distribution.
+//
+// Targets not started yet are skipped once one of them fails,
+// unless building is requested to keep going.
+func buildSource(dock docker.Engine, dir string) error {
+	path := filepath.Join(dir, "debian/changelog")
+	ch, err := changelog.ParseFileOne(path)
 	if err != nil {
 		return err
 	}
 
-	path := filepath.Join(cwd, "debian/changelog")
-	ch, err := changelog.ParseFileOne(path)
+	err = loadPackageConfig(filepath.Join(dir, "debian/deber.conf"))
 	if err != nil {
 		return err
 	}
 
-	if *targetDist == "" {
-		*targetDist = ch.Target
+	signingKey = *signKey
+	if *sign && signingKey == "" {
+		signingKey = os.Getenv("DEBSIGN_KEYID")
+	}
+	if (*gpgAgent || *sign) && signingKey == "" {
+		signingKey, err = steps.SigningKey(ch.ChangedBy)
+		if err != nil {
+			return err
+		}
 	}
 
+	if *ppa {
+		// Flags from command line or package config take precedence
+		if *dpkgFlags == pflag.Lookup("dpkg-flags").DefValue {
+			*dpkgFlags = ppaDpkgFlags
+		}
+		repos = []string{"ubuntu"}
+	}
+
+	err = checkControl(filepath.Join(dir, "debian/control"), buildArch(), *indep)
+	if err != nil {
+		return err
+	}
+
+	targets := *targetDists
+	if len(targets) == 0 {
+		target := *targetDist
+		if target == "" {
+			target = ch.Target
+		}
+		targets = []string{target}
+	} else if *targetDist != "" {
+		return errors.New("--target-dist and --targets are mutually exclusive")
+	}
+
+	if len(targets) == 1 {
+		return pipelineWithRetries(dock, newNaming(ch, dir, targets[0]), false)
+	}
+
+	if *shell {
+		return errors.New("shell can't be launched for multiple targets")
+	}
+	if *jobs < 1 {
+		return errors.New("number of jobs must be at least 1")
+	}
+
+	results := make([]result, len(targets))
+	semaphore := make(chan struct{}, *jobs)
+	failed := atomic.Bool{}
+	wg := sync.WaitGroup{}
+
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			results[i].target = target
+			if failed.Load() && !*keepGoing {
+				results[i].status = statusSkipped
+				return
+			}
+
+			n := newNaming(ch, dir, target)
+
+			// Log and output of concurrent builds are told apart by target
+			logger := log.New(target)
+			log.Register(n.Container, logger)
+			defer log.Unregister(n.Container)
+			targetDock := dock.WithOutput(logger.Output)
+
+			begin := time.Now()
+			err := pipelineWithRetries(targetDock, n, true)
+			results[i].duration = time.Since(begin)
+
+			if err != nil {
+				results[i].status = statusFailed
+				results[i].err = err
+				failed.Store(true)
+				return
+			}
+
+			results[i].status = statusDone
+			results[i].size = packagesSize(n)
+		}()
+	}
+
+	wg.Wait()
+
+	return summarize("target", results)
+}
+
+// newNaming returns naming of package in given
+// directory, built for given target.
+func newNaming(ch *changelog.ChangelogEntry, dir, target string) *naming.Naming {
 	namingArgs := naming.Args{
-		Prefix:          Program,
+		Prefix:          *prefix,
 		Source:          ch.Source,
 		Version:         ch.Version.String(),
 		Upstream:        ch.Version.Version,
-		Target:          *targetDist,
-		SourceBaseDir:   cwd,
+		Target:          target,
+		Arch:            foreignArch(),
+		SourceBaseDir:   dir,
 		BuildBaseDir:    *buildDir,
 		CacheBaseDir:    *cacheDir,
 		PackagesBaseDir: packagesDir,
 	}
-	n := naming.New(namingArgs)
+	return naming.New(namingArgs)
+}
 
-	err = steps.Build(dock, n, *age)
-	if err != nil {
-		return err
+// resolveDirs sets directories not given on command line
+// to their defaults.
+func resolveDirs() {
+	if *systemDir == "" {
+		*systemDir = filepath.Join(os.TempDir(), Program)
 	}
 
-	err = steps.Create(dock, n, *packages)
-	if err != nil {
-		return err
+	if *buildDir == "" {
+		*buildDir = filepath.Join(*systemDir, "builddir")
 	}
 
-	err = steps.Start(dock, n)
-	if err != nil {
-		return err
+	if *cacheDir == "" {
+		*cacheDir = filepath.Join(*systemDir, "cachedir")
 	}
 
-	if *shell {
-		return steps.ShellOptional(dock, n)
+	packagesDir = filepath.Join(*systemDir, "packages")
+	sourcesDir = filepath.Join(*systemDir, "sources")
+	languagesDir = filepath.Join(*systemDir, "languages")
+}
+
+func createDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	err = steps.Tarball(n)
+// loadPackageConfig reads package specific options from file
+// in source tree, if it exists. Options are given as "flag = value"
+// lines, where only some flags are allowed, and they don't override
+// ones passed on command line.
+func loadPackageConfig(path string) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	err = steps.Depends(dock, n, *packages)
-	if err != nil {
-		return err
+	// Values are gathered first, as setting slice flag would append
+	// to values of previous package instead of replacing them
+	names := make([]string, 0)
+	values := make(map[string][]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if !ok || !slices.Contains(packageConfigFlags, name) {
+			return fmt.Errorf("%s: invalid option: %s", path, line)
+		}
+
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+		if pflag.Lookup(name).Value.Type() == "stringSlice" {
+			values[name] = append(values[name], strings.Split(value, ",")...)
+		} else {
+			values[name] = append(values[name], value)
+		}
 	}
 
-	err = steps.Package(dock, n, *dpkgFlags, *network, *tests)
-	if err != nil {
-		errStop := steps.Stop(dock, n)
-		if errStop != nil {
-			fmt.Printf("%s", errStop)
+	for _, name := range names {
+		flag := pflag.Lookup(name)
+		if flag.Changed {
+			continue
 		}
-		errRemove := steps.Remove(dock, n)
-		if errRemove != nil {
-			fmt.Printf("%s", errRemove)
+
+		err = setFlagValues(flag, values[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
 		}
-		return err
 	}
 
-	err = steps.Lint(dock, n, *lintianFlags, *lintian)
-	if err != nil {
-		return err
+	return nil
+}
+
+// loadConfig reads configuration file, given with --config
+// or the default one, before flags are parsed, so its values
+// become defaults of flags, overridden by command line
+// and package config.
+//
+// Missing default file is ignored, explicitly given one is not.
+func loadConfig(args []string) error {
+	path := ""
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if value, ok := strings.CutPrefix(arg, "--config="); ok {
+			path = value
+		}
+		if arg == "--config" && i+1 < len(args) {
+			path = args[i+1]
+		}
 	}
 
-	err = steps.Archive(n)
+	var err error
+	if path == "" {
+		userConfig, err = config.Load()
+	} else if !isFile(path) {
+		return fmt.Errorf("config file not found: %s", path)
+	} else {
+		userConfig, err = config.LoadFile(path)
+	}
 	if err != nil {
 		return err
 	}
 
-	err = steps.Stop(dock, n)
-	if err != nil {
-		return err
+	names := make([]string, 0, len(userConfig.Flags))
+	for name := range userConfig.Flags {
+		names = append(names, name)
 	}
+	slices.Sort(names)
 
-	if *noRemove {
-		return nil
+	for _, name := range names {
+		flag := pflag.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("%s: unknown option: %s", userConfig.Path, name)
+		}
+
+		err = setFlagValues(flag, userConfig.Flags[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", userConfig.Path, name, err)
+		}
+
+		flag.DefValue = flag.Value.String()
+	}
+
+	return nil
+}
+
+// setFlagValues sets flag to given values, which
+// have to be just one unless flag is a list.
+func setFlagValues(flag *pflag.Flag, values []string) error {
+	if value, ok := flag.Value.(pflag.SliceValue); ok {
+		return value.Replace(values)
+	}
+
+	if len(values) != 1 {
+		return errors.New("only one value expected")
+	}
+
+	return flag.Value.Set(values[0])
+}
+
+// checkControl validates debian/control before anything expensive
+// happens, that is build dependencies syntax and if any binary
+// package can be built on given architecture, or if there are
+// architecture independent ones, when only those are going to be built.
+//
+// Missing control file generated from control.in is pointed out,
+// as build dependencies can't be known before it's generated.
+func checkControl(path, arch string, indepOnly bool) error {
+	paragraphs, err := control.ParseFile(path)
+	if errors.Is(err, os.ErrNotExist) && isFile(path+".in") {
+		return errors.New("debian/control is missing, generate it from debian/control.in first (like with \"debian/rules debian/control\")")
 	}
-	err = steps.Remove(dock, n)
 	if err != nil {
-		return err
+		return fmt.Errorf("debian/control: %w", err)
+	}
+	if len(paragraphs) < 2 {
+		return errors.New("debian/control: no binary packages defined")
 	}
 
-	return nil
+	source := paragraphs[0]
+	for _, field := range []string{"Build-Depends", "Build-Depends-Arch", "Build-Depends-Indep"} {
+		err = control.ValidateRelations(source[field])
+		if err != nil {
+			return fmt.Errorf("debian/control: %s: %w", field, err)
+		}
+	}
+
+	architectures := make([]string, 0)
+	for _, binary := range paragraphs[1:] {
+		if indepOnly && binary["Architecture"] == "all" {
+			return nil
+		}
+		if !indepOnly && control.MatchesArch(binary["Architecture"], arch) {
+			return nil
+		}
+		architectures = append(architectures, binary["Architecture"])
+	}
+
+	if indepOnly {
+		return errors.New("debian/control: no architecture independent packages to build")
+	}
+
+	return fmt.Errorf(
+		"debian/control: no binary package can be built on %s (Architecture: %s)",
+		arch,
+		strings.Join(architectures, ", "),
+	)
 }
 
-func createDirs(dirs ...string) error {
+// isFile checks if there is regular file at given path.
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// hostArch returns Debian name of host architecture.
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "386":
+		return "i386"
+	case "arm":
+		return "armhf"
+	case "ppc64le":
+		return "ppc64el"
+	case "mips64le":
+		return "mips64el"
+	case "mipsle":
+		return "mipsel"
+	default:
+		return runtime.GOARCH
+	}
+}
+
+// buildArch returns Debian name of architecture
+// package is built for.
+func buildArch() string {
+	if *arch != "" {
+		return *arch
+	}
+
+	return hostArch()
+}
+
+// foreignArch returns architecture package is built for,
+// if it's other than host one, or empty string.
+func foreignArch() string {
+	if buildArch() == hostArch() {
+		return ""
+	}
+
+	return *arch
+}
+
+func checkFreeSpace(minimum string, dirs ...string) error {
+	required, err := units.RAMInBytes(minimum)
+	if err != nil {
+		return fmt.Errorf("invalid minimum free space: %w", err)
+	}
+	if required <= 0 {
+		return nil
+	}
+
 	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		available, err := util.FreeSpace(dir)
+		if err != nil {
 			return err
 		}
+
+		if available < uint64(required) {
+			return fmt.Errorf(
+				"not enough free space in %s: %s available, %s required (see --min-free-space)",
+				dir,
+				units.BytesSize(float64(available)),
+				units.BytesSize(float64(required)),
+			)
+		}
 	}
+
 	return nil
 }
+
+// parseLabels returns map of labels given as KEY=VALUE,
+// refusing ones in namespace reserved for deber.
+func parseLabels(list []string) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	for _, label := range list {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label: %s", label)
+		}
+		if strings.HasPrefix(key, Program+".") {
+			return nil, fmt.Errorf("label %s is reserved", key)
+		}
+
+		labels[key] = value
+	}
+
+	return labels, nil
+}
+
+// parseStepTimeouts returns map of step timeouts given as STEP=DURATION.
+func parseStepTimeouts(list []string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+
+	for _, item := range list {
+		step, value, ok := strings.Cut(item, "=")
+		if !ok || !slices.Contains(stepOrder, step) {
+			return nil, fmt.Errorf("invalid step timeout: %s", item)
+		}
+
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid step timeout: %s", item)
+		}
+
+		timeouts[step] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// imageMirrors returns apt mirrors used in images, either vendor
+// specific ones, or archives of the common one.
+func imageMirrors() (dockerfile.Mirrors, error) {
+	mirrors := dockerfile.Mirrors{
+		Debian: *debianMirror,
+		Ubuntu: *ubuntuMirror,
+	}
+
+	if *mirror != "" {
+		base := strings.TrimSuffix(*mirror, "/")
+		if mirrors.Debian == "" {
+			mirrors.Debian = base + "/debian"
+		}
+		if mirrors.Ubuntu == "" {
+			mirrors.Ubuntu = base + "/ubuntu"
+		}
+	}
+
+	for _, m := range []string{*mirror, mirrors.Debian, mirrors.Ubuntu} {
+		if m != "" && !mirrorRegexp.MatchString(m) {
+			return mirrors, fmt.Errorf("invalid mirror: %s", m)
+		}
+	}
+
+	return mirrors, nil
+}
+
+// resolveProfiles returns space separated build profiles,
+// either explicitly given ones or those mapped to the target.
+func resolveProfiles(target, explicit string, mapping []string) (string, error) {
+	for _, m := range mapping {
+		t, p, ok := strings.Cut(m, "=")
+		if !ok || t == "" || p == "" {
+			return "", fmt.Errorf("invalid target profiles mapping: %s", m)
+		}
+
+		if explicit == "" && t == target {
+			explicit = p
+		}
+	}
+
+	list := strings.FieldsFunc(explicit, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	for _, profile := range list {
+		if !profileRegexp.MatchString(profile) {
+			return "", fmt.Errorf("invalid build profile: %s", profile)
+		}
+	}
+
+	return strings.Join(list, " "), nil
+}
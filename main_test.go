@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/config"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStepTimeouts(t *testing.T) {
+	timeouts, err := parseStepTimeouts([]string{"depends=10m", "package=2h"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{stepDepends: 10 * time.Minute, stepPackage: 2 * time.Hour}, timeouts)
+
+	for _, item := range []string{"depends", "unknown=1m", "package=soon", "package=0s", "package=-1m"} {
+		_, err := parseStepTimeouts([]string{item})
+		assert.EqualError(t, err, "invalid step timeout: "+item)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels([]string{"team=core", "ci.job=42", "empty="})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "core", "ci.job": "42", "empty": ""}, labels)
+
+	_, err = parseLabels([]string{"novalue"})
+	assert.EqualError(t, err, "invalid label: novalue")
+	_, err = parseLabels([]string{"=value"})
+	assert.EqualError(t, err, "invalid label: =value")
+	_, err = parseLabels([]string{"deber.parent=debian"})
+	assert.EqualError(t, err, "label deber.parent is reserved")
+}
+
+func TestLoadPackageConfigTwice(t *testing.T) {
+	// Defaults from configuration file are restored between packages
+	saved := userConfig
+	userConfig = &config.Config{Flags: map[string][]string{"package": {"../default"}}}
+	t.Cleanup(func() {
+		userConfig = saved
+		assert.NoError(t, resetPackageConfig())
+	})
+	assert.NoError(t, resetPackageConfig())
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.conf")
+	second := filepath.Join(dir, "second.conf")
+	assert.NoError(t, os.WriteFile(first, []byte("package = ../libfoo\npackage = ../libbar\nstep-timeouts = depends=1m,package=1h\ndpkg-flags = -b -j4\n"), 0644))
+	assert.NoError(t, os.WriteFile(second, []byte("package = ../libbaz\n"), 0644))
+
+	assert.NoError(t, loadPackageConfig(first))
+	assert.Equal(t, []string{"../libfoo", "../libbar"}, *packages)
+	assert.Equal(t, []string{"depends=1m", "package=1h"}, *stepTimeouts)
+	assert.Equal(t, "-b -j4", *dpkgFlags)
+
+	assert.NoError(t, resetPackageConfig())
+	assert.Equal(t, []string{"../default"}, *packages)
+	assert.NoError(t, loadPackageConfig(second))
+	assert.Equal(t, []string{"../libbaz"}, *packages)
+	assert.Empty(t, *stepTimeouts)
+	assert.Equal(t, pflag.Lookup("dpkg-flags").DefValue, *dpkgFlags)
+}
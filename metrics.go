@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+// metric holds duration and outcome of a step, or of
+// the whole pipeline if step is empty.
+type metric struct {
+	source   string
+	target   string
+	step     string
+	status   string
+	duration time.Duration
+}
+
+var (
+	// metrics are keyed by source, target and step, so only
+	// the last attempt of retried pipeline is kept
+	metrics      = make(map[string]metric)
+	metricsMutex sync.Mutex
+)
+
+// recordMetric stores duration and outcome of a step
+// (or the whole pipeline, if step is empty).
+func recordMetric(n *naming.Naming, step string, err error, duration time.Duration) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	status := statusDone
+	if err != nil {
+		status = statusFailed
+	}
+
+	metrics[n.Source+"/"+n.Target+"/"+step] = metric{
+		source:   n.Source,
+		target:   n.Target,
+		step:     step,
+		status:   status,
+		duration: duration,
+	}
+}
+
+// writeMetrics writes recorded metrics to file in Prometheus
+// textfile collector format. File is replaced atomically,
+// so it's never scraped half written.
+func writeMetrics(path string) error {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	builder := new(strings.Builder)
+
+	fmt.Fprintf(builder, "# HELP %s_step_duration_seconds Duration of pipeline step.\n", Program)
+	fmt.Fprintf(builder, "# TYPE %s_step_duration_seconds gauge\n", Program)
+	for _, key := range keys {
+		m := metrics[key]
+		if m.step == "" {
+			continue
+		}
+		fmt.Fprintf(
+			builder,
+			"%s_step_duration_seconds{source=%q,target=%q,step=%q,status=%q} %f\n",
+			Program, m.source, m.target, m.step, m.status, m.duration.Seconds(),
+		)
+	}
+
+	fmt.Fprintf(builder, "# HELP %s_build_duration_seconds Duration of whole build.\n", Program)
+	fmt.Fprintf(builder, "# TYPE %s_build_duration_seconds gauge\n", Program)
+	for _, key := range keys {
+		m := metrics[key]
+		if m.step != "" {
+			continue
+		}
+		fmt.Fprintf(builder, "%s_build_duration_seconds{source=%q,target=%q} %f\n", Program, m.source, m.target, m.duration.Seconds())
+	}
+
+	fmt.Fprintf(builder, "# HELP %s_build_success Whether build succeeded.\n", Program)
+	fmt.Fprintf(builder, "# TYPE %s_build_success gauge\n", Program)
+	for _, key := range keys {
+		m := metrics[key]
+		if m.step != "" {
+			continue
+		}
+
+		success := 0
+		if m.status == statusDone {
+			success = 1
+		}
+		fmt.Fprintf(builder, "%s_build_success{source=%q,target=%q} %d\n", Program, m.source, m.target, success)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.WriteString(builder.String())
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	err = temp.Close()
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	err = os.Chmod(temp.Name(), 0644)
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/dockerfile"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+	"github.com/dpvpro/deber/pkg/steps"
+)
+
+const (
+	stepBuild    = "build"
+	stepCreate   = "create"
+	stepStart    = "start"
+	stepTarball  = "tarball"
+	stepDepends  = "depends"
+	stepValidate = "validate"
+	stepPackage  = "package"
+	stepSign     = "sign"
+	stepLint     = "lint"
+	stepCompare  = "compare"
+	stepArchive  = "archive"
+	stepUpload   = "upload"
+)
+
+// retryDelay is the delay before first retry, doubled every next one
+const retryDelay = 10 * time.Second
+
+// stepOrder is the order in which steps are run
+var stepOrder = []string{
+	stepBuild,
+	stepCreate,
+	stepStart,
+	stepTarball,
+	stepDepends,
+	stepValidate,
+	stepPackage,
+	stepSign,
+	stepLint,
+	stepCompare,
+	stepArchive,
+	stepUpload,
+}
+
+// pipeline runs all the steps for a single target,
+// or just some of them if requested, and cleans up.
+func pipeline(dock docker.Engine, n *naming.Naming, keepTarball bool) error {
+	buildProfiles, err := resolveProfiles(n.Target, *profiles, *targetProfs)
+	if err != nil {
+		return err
+	}
+
+	extraLabels, err := parseLabels(*labels)
+	if err != nil {
+		return err
+	}
+
+	languageCaches := make([]string, 0)
+	for name, enabled := range map[string]bool{"go": *cacheGo, "cargo": *cacheCargo, "npm": *cacheNpm} {
+		if enabled {
+			languageCaches = append(languageCaches, name)
+		}
+	}
+	slices.Sort(languageCaches)
+
+	timeouts, err := parseStepTimeouts(*stepTimeouts)
+	if err != nil {
+		return err
+	}
+
+	mirrors, err := imageMirrors()
+	if err != nil {
+		return err
+	}
+
+	imagePkgs, err := dockerfile.ImagePackages(*imagePackages)
+	if err != nil {
+		return err
+	}
+
+	extraPackages := append(slices.Clone(*packages), *withLocal...)
+	for _, name := range localSources {
+		dir := filepath.Join(n.PackagesTargetDir, name)
+		if _, err := os.Stat(dir); err == nil {
+			extraPackages = append(extraPackages, dir)
+		}
+	}
+
+	buildArgs := steps.BuildArgs{
+		MaxAge:    *age,
+		ImageFrom: *imageFrom,
+		Repos:     repos,
+		Labels:    extraLabels,
+		Offline:   *offline,
+		Mirrors:   mirrors,
+		Packages:  imagePkgs,
+		Cache:     *imageCache,
+	}
+	createArgs := steps.CreateArgs{
+		ExtraPackages:     extraPackages,
+		SourcesList:       *sourcesList,
+		Snapshot:          *snapshot,
+		KeepVolumes:       *keepVolumes,
+		GpgAgent:          *gpgAgent || *sign,
+		Hostname:          *hostname,
+		DNS:               *dns,
+		ExtraHosts:        *addHosts,
+		ReadOnlySource:    *sourceRO,
+		TmpDir:            *tmpDir,
+		TmpDirFrom:        *tmpDirFrom,
+		Labels:            extraLabels,
+		Init:              *initProcess,
+		CopySource:        *copySource,
+		LanguageCaches:    languageCaches,
+		LanguageCachesDir: languagesDir,
+		Runtime:           *containerRuntime,
+		Rootless:          *rootless,
+		Memory:            *memory,
+		CPUs:              *cpus,
+	}
+	dependsArgs := steps.DependsArgs{
+		ExtraPackages:        extraPackages,
+		InstallRecommends:    *recommends,
+		SourcesList:          *sourcesList,
+		RecordFile:           *recordDeps,
+		ReplayFile:           *replayDeps,
+		FreshLists:           *freshLists,
+		AptPin:               *aptPin,
+		PreferLocal:          len(*withLocal) > 0 || len(localSources) > 0,
+		SeedFile:             *seedPackages,
+		Profiles:             buildProfiles,
+		Upgrade:              *upgrade,
+		Snapshot:             *snapshot,
+		MaxParallelDownloads: *maxDownloads,
+		Lock:                 *lockDeps,
+		NoNetwork:            *noNetworkDeps,
+		Resolver:             *resolver,
+	}
+	packageArgs := steps.PackageArgs{
+		DpkgFlags:           *dpkgFlags,
+		Network:             *network,
+		Tests:               *tests,
+		Profiles:            buildProfiles,
+		ChangesDistribution: *changesDist,
+		ChangesUrgency:      *changesUrgency,
+		GpgAgent:            *gpgAgent,
+		SignKey:             signingKey,
+		IndepOnly:           *indep,
+		Locale:              *locale,
+		ReadOnlySource:      *sourceRO,
+		TmpDir:              *tmpDir,
+		Umask:               *umask,
+		TestOnly:            *testOnly,
+		LanguageCaches:      languageCaches,
+		OnlyPackages:        *onlyPackages,
+		Trace:               *trace,
+		TraceOptions:        *traceOptions,
+	}
+	if *verifyArch {
+		packageArgs.VerifyArchitecture = buildArch()
+	}
+	tarballArgs := steps.TarballArgs{
+		// Tarball stays in place if other targets need it too
+		KeepSource:   keepTarball,
+		Verify:       *verifyTarball,
+		Compressions: *tarballCompress,
+		Path:         *tarballPath,
+	}
+	signArgs := steps.SignArgs{
+		Enabled: *sign,
+		Key:     signingKey,
+	}
+	uploadArgs := steps.UploadArgs{
+		Target: *upload,
+		Config: *uploadConfig,
+	}
+	lintArgs := steps.LintArgs{
+		Enabled:      *lint,
+		LintianFlags: *lintianFlags,
+		FailOn:       *lintianFailOn,
+		Split:        *lintianSplit,
+		NoUdeb:       *lintianNoUdeb,
+		IndepOnly:    *indep,
+		ReportFile:   *lintianJSON,
+		Allow:        *lintianAllow,
+	}
+	compareArgs := steps.CompareArgs{
+		Mirror:           *compareMirror,
+		DiffoscopeReport: *diffoscope,
+	}
+
+	// Steps run with their own client, so cleanup isn't cancelled with them
+	build := dock
+	if *buildTimeout > 0 {
+		var cancel context.CancelFunc
+		build, cancel = dock.WithTimeout(*buildTimeout)
+		defer cancel()
+	}
+
+	runners := map[string]func(dock docker.Engine) error{
+		stepBuild: func(dock docker.Engine) error {
+			return steps.Build(dock, n, buildArgs)
+		},
+		stepCreate: func(dock docker.Engine) error {
+			return steps.Create(dock, n, createArgs)
+		},
+		stepStart: func(dock docker.Engine) error {
+			err := steps.Start(dock, n)
+			if err != nil {
+				return err
+			}
+			return copySourceIfNeeded(dock, n)
+		},
+		stepTarball: func(dock docker.Engine) error {
+			return steps.Tarball(n, tarballArgs)
+		},
+		stepDepends: func(dock docker.Engine) error {
+			downloads := new(steps.Downloads)
+			dependsArgs.Downloads = downloads
+
+			err := steps.Depends(dock, n, dependsArgs)
+			if err == nil {
+				recordDownloads(n, *downloads)
+			}
+			if err != nil && len(*addHosts) > 0 {
+				return fmt.Errorf("%w (hosts mapped with --add-host: %s)", err, strings.Join(*addHosts, ", "))
+			}
+			return err
+		},
+		stepValidate: func(dock docker.Engine) error {
+			return steps.Validate(dock, n, *validate)
+		},
+		stepPackage: func(dock docker.Engine) error {
+			return steps.Package(dock, n, packageArgs)
+		},
+		stepSign: func(dock docker.Engine) error {
+			return steps.Sign(dock, n, signArgs)
+		},
+		stepLint: func(dock docker.Engine) error {
+			return steps.Lint(dock, n, lintArgs)
+		},
+		stepCompare: func(dock docker.Engine) error {
+			return steps.Compare(dock, n, compareArgs)
+		},
+		stepArchive: func(dock docker.Engine) error {
+			return steps.Archive(n, *umask)
+		},
+		stepUpload: func(dock docker.Engine) error {
+			return steps.Upload(n, uploadArgs)
+		},
+	}
+
+	first := 0
+	if *startFrom != "" {
+		first = slices.Index(stepOrder, *startFrom)
+
+		err = checkPrerequisites(dock, n, first)
+		if err != nil {
+			return err
+		}
+
+		// Source might have changed since start
+		if first > slices.Index(stepOrder, stepStart) {
+			err = copySourceIfNeeded(dock, n)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range stepOrder[first:] {
+		begin := time.Now()
+		err = runStep(dock, build, n, name, runners[name], timeouts[name])
+		recordMetric(n, name, err, time.Since(begin))
+		if err != nil && build.TimedOut() {
+			err = fmt.Errorf("build timed out after %s: %w", *buildTimeout, err)
+		}
+		if err != nil {
+			err = &stepError{step: name, err: err}
+			if *snapshotOnFailure != "" && slices.Index(stepOrder, name) > slices.Index(stepOrder, stepCreate) {
+				errSnapshot := steps.Snapshot(dock, n, *snapshotOnFailure)
+				if errSnapshot != nil {
+					fmt.Fprintf(log.For(n.Container).Output, "%s", errSnapshot)
+				}
+			}
+			// Timed out build is cleaned up as after failed package step
+			if name == stepPackage || build.TimedOut() {
+				errStop := steps.Stop(dock, n)
+				if errStop != nil {
+					fmt.Fprintf(log.For(n.Container).Output, "%s", errStop)
+				}
+				errRemove := steps.Remove(dock, n, *keepVolumes)
+				if errRemove != nil {
+					fmt.Fprintf(log.For(n.Container).Output, "%s", errRemove)
+				}
+			}
+			return err
+		}
+
+		if name == stepStart && *shell {
+			return steps.ShellOptional(dock, n)
+		}
+
+		// Nothing to lint or archive without packages
+		if name == *stopAfter || (*testOnly && name == stepPackage) {
+			break
+		}
+	}
+
+	err = steps.Stop(dock, n)
+	if err != nil {
+		return err
+	}
+
+	if *noRemove {
+		return nil
+	}
+	err = steps.Remove(dock, n, *keepVolumes)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// retryableSteps are steps failing mostly because of network
+// or mirror problems, rather than the package itself
+var retryableSteps = []string{stepBuild, stepDepends}
+
+// stepError wraps error of a failed step.
+type stepError struct {
+	step string
+	err  error
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// pipelineWithRetries runs pipeline again, after increasing delay,
+// as long as it fails in one of retryable steps.
+func pipelineWithRetries(dock docker.Engine, n *naming.Naming, keepTarball bool) error {
+	delay := retryDelay
+
+	begin := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := pipeline(dock, n, keepTarball)
+		recordMetric(n, "", err, time.Since(begin))
+
+		if err == nil && *provenanceFile != "" {
+			err = recordProvenance(dock, n)
+		}
+
+		if *summaryJSON != "" {
+			recordSummary(n, err)
+		}
+
+		var stepErr *stepError
+		if err == nil || attempt > *retries || !errors.As(err, &stepErr) || !slices.Contains(retryableSteps, stepErr.step) {
+			return err
+		}
+
+		logger := log.For(n.Container)
+		logger.Error(err)
+		logger.Info(fmt.Sprintf("Retrying in %s (%d of %d)", delay, attempt, *retries))
+		time.Sleep(delay)
+		_ = logger.Done()
+
+		delay *= 2
+	}
+}
+
+// runStep runs step with client of given build, failing it
+// if it doesn't finish in time.
+//
+// Requests of timed out step are cancelled and its container
+// is stopped, so commands hanging in it are killed. Step is
+// always waited for, so it can't outlive the pipeline.
+func runStep(dock, build docker.Engine, n *naming.Naming, name string, runner func(docker.Engine) error, timeout time.Duration) error {
+	if timeout == 0 {
+		return runner(build)
+	}
+
+	step, cancel := build.WithTimeout(timeout)
+	defer cancel()
+
+	if slices.Index(stepOrder, name) > slices.Index(stepOrder, stepCreate) {
+		timer := time.AfterFunc(timeout, func() {
+			err := dock.ContainerStop(n.Container)
+			if err != nil {
+				fmt.Fprintf(log.For(n.Container).Output, "%s", err)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	err := runner(step)
+	if step.TimedOut() && !build.TimedOut() {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+
+	return err
+}
+
+// copySourceIfNeeded copies source, or its debian directory,
+// to container if it isn't mounted writable there.
+func copySourceIfNeeded(dock docker.Engine, n *naming.Naming) error {
+	switch {
+	case *copySource:
+		return steps.CopySource(dock, n, *copySourceIgnore)
+	case *sourceRO:
+		return steps.CopyDebian(dock, n)
+	}
+
+	return nil
+}
+
+// checkPrerequisites verifies that state left by steps
+// before the first one to run is in place.
+func checkPrerequisites(dock docker.Engine, n *naming.Naming, first int) error {
+	hint := fmt.Sprintf("run without --start-from %s first", stepOrder[first])
+
+	if first > slices.Index(stepOrder, stepBuild) {
+		isImageBuilt, err := dock.IsImageBuilt(n.Image)
+		if err != nil {
+			return err
+		}
+		if !isImageBuilt {
+			return fmt.Errorf("image %s is not built, %s", n.Image, hint)
+		}
+	}
+
+	if first > slices.Index(stepOrder, stepCreate) {
+		isContainerCreated, err := dock.IsContainerCreated(n.Container)
+		if err != nil {
+			return err
+		}
+		if !isContainerCreated {
+			return fmt.Errorf("container %s is not created, %s", n.Container, hint)
+		}
+	}
+
+	if first > slices.Index(stepOrder, stepStart) {
+		isContainerStarted, err := dock.IsContainerStarted(n.Container)
+		if err != nil {
+			return err
+		}
+		if !isContainerStarted {
+			return fmt.Errorf("container %s is not started, %s", n.Container, hint)
+		}
+	}
+
+	return nil
+}
+
+const (
+	statusDone    = "done"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// result holds outcome of a pipeline for single target.
+type result struct {
+	target   string
+	status   string
+	duration time.Duration
+	size     int64
+	err      error
+}
+
+// packagesSize returns total size of binary packages built
+// for target, or 0 if it can't be determined.
+func packagesSize(n *naming.Naming) int64 {
+	files, _ := filepath.Glob(filepath.Join(n.BuildDir, fmt.Sprintf("*_%s_*.*deb", n.VersionNoEpoch)))
+
+	total := int64(0)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0
+		}
+		total += info.Size()
+	}
+
+	return total
+}
+
+// summarize prints table with results of all targets
+// (or sources) and returns error if any of them failed.
+func summarize(kind string, results []result) error {
+	fmt.Fprintln(log.Output)
+
+	writer := tabwriter.NewWriter(log.Output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.ToUpper(kind)+"\tSTATUS\tDURATION\tSIZE\tERROR")
+
+	failures := 0
+	for _, r := range results {
+		errMsg := ""
+		if r.err != nil {
+			errMsg = r.err.Error()
+			failures++
+		}
+
+		size := "-"
+		if r.size > 0 {
+			size = units.HumanSize(float64(r.size))
+		}
+
+		duration := r.duration.Round(time.Second)
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", r.target, r.status, duration, size, errMsg)
+	}
+
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d %ss failed", failures, len(results), kind)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+// Package config includes parsing of user configuration file
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config struct represents user configuration,
+// that is values of flags keyed by their names.
+type Config struct {
+	// Path is where configuration was read from,
+	// empty if there was no file
+	Path string
+	// Flags are values of flags, more than one
+	// only for lists, like in "targets: [unstable, bookworm]"
+	Flags map[string][]string
+}
+
+// DefaultPath function returns path of configuration file
+// in user's configuration directory, $XDG_CONFIG_HOME/deber/config.yaml.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "deber", "config.yaml"), nil
+}
+
+// Load function reads configuration from default path.
+func Load() (*Config, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return &Config{Flags: map[string][]string{}}, nil
+	}
+
+	return LoadFile(path)
+}
+
+// LoadFile function reads configuration from given path.
+//
+// Missing file gives empty configuration, as all of the flags
+// keep their defaults then.
+func LoadFile(path string) (*Config, error) {
+	config := &Config{
+		Flags: map[string][]string{},
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]any{}
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, value := range document {
+		values, err := flagValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+
+		config.Flags[name] = values
+	}
+
+	config.Path = path
+
+	return config, nil
+}
+
+// flagValues function converts YAML value, scalar or list
+// of scalars, to values of flag.
+func flagValues(value any) ([]string, error) {
+	switch v := value.(type) {
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if !isScalar(item) {
+				return nil, errors.New("list can hold only scalar values")
+			}
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	default:
+		if !isScalar(v) {
+			return nil, errors.New("value has to be scalar or list")
+		}
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+// isScalar function checks if YAML value is string, number or bool.
+func isScalar(value any) bool {
+	switch value.(type) {
+	case string, int, float64, bool:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,47 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpvpro/deber/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "dpkg-flags: -b -uc -us\njobs: 2\nlintian: true\ntargets: [unstable, bookworm]\n"
+
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.NoError(t, err)
+
+	c, err := config.LoadFile(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, path, c.Path)
+	assert.Equal(t, map[string][]string{
+		"dpkg-flags": {"-b -uc -us"},
+		"jobs":       {"2"},
+		"lintian":    {"true"},
+		"targets":    {"unstable", "bookworm"},
+	}, c.Flags)
+}
+
+func TestLoadFileMissing(t *testing.T) {
+	c, err := config.LoadFile(filepath.Join(t.TempDir(), "config.yaml"))
+	assert.NoError(t, err)
+
+	assert.Empty(t, c.Path)
+	assert.Empty(t, c.Flags)
+}
+
+func TestLoadFileNested(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte("labels:\n  team: build\n"), 0644)
+	assert.NoError(t, err)
+
+	_, err = config.LoadFile(path)
+	assert.Error(t, err)
+}
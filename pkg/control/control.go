@@ -0,0 +1,131 @@
+// Package control includes debian/control parsing utilities
+package control
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// relationRegexp matches single package relation, like:
+// foo:any (>= 1.0) [amd64 !i386] <!nocheck>
+var relationRegexp = regexp.MustCompile(
+	`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?` +
+		`( ?\((<<|<=|=|>=|>>) ?[^()\s]+\))?` +
+		`( ?\[!?[a-z0-9-]+( !?[a-z0-9-]+)*\])?` +
+		`( ?<!?[a-z0-9.-]+( !?[a-z0-9.-]+)*>)*$`,
+)
+
+// Paragraph maps field names of single control file
+// paragraph to their values.
+//
+// Values of multiline fields have lines joined with new line.
+type Paragraph map[string]string
+
+// Parse function reads paragraphs in deb822 format.
+func Parse(reader io.Reader) ([]Paragraph, error) {
+	paragraphs := make([]Paragraph, 0)
+	paragraph := Paragraph{}
+	field := ""
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.TrimSpace(line) == "":
+			if len(paragraph) > 0 {
+				paragraphs = append(paragraphs, paragraph)
+			}
+			paragraph = Paragraph{}
+			field = ""
+		case line[0] == ' ' || line[0] == '\t':
+			if field == "" {
+				return nil, fmt.Errorf("continuation line without field: %s", line)
+			}
+			paragraph[field] += "\n" + strings.TrimSpace(line)
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid line: %s", line)
+			}
+			field = name
+			paragraph[field] = strings.TrimSpace(value)
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paragraph) > 0 {
+		paragraphs = append(paragraphs, paragraph)
+	}
+
+	return paragraphs, nil
+}
+
+// ParseFile function reads paragraphs from file at given path.
+func ParseFile(path string) ([]Paragraph, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+// ValidateRelations function checks syntax of relationship
+// field like Build-Depends.
+func ValidateRelations(field string) error {
+	for _, relation := range strings.Split(field, ",") {
+		relation = strings.TrimSpace(relation)
+
+		// Trailing comma is allowed
+		if relation == "" {
+			continue
+		}
+
+		for _, alternative := range strings.Split(relation, "|") {
+			alternative = strings.Join(strings.Fields(alternative), " ")
+			if !relationRegexp.MatchString(alternative) {
+				return fmt.Errorf("invalid relation: %s", alternative)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MatchesArch function checks if any of architectures
+// in Architecture field can be built on given one.
+//
+// Architecture independent packages match any architecture.
+func MatchesArch(field, arch string) bool {
+	for _, wildcard := range strings.Fields(field) {
+		if wildcard == "all" || wildcard == "any" || wildcard == arch {
+			return true
+		}
+
+		// <os>-any and any-<cpu>, only Linux is supported
+		osName, cpu, ok := strings.Cut(wildcard, "-")
+		if !ok {
+			continue
+		}
+		if osName == "linux" && cpu == "any" {
+			return true
+		}
+		if osName == "any" && cpu == arch {
+			return true
+		}
+	}
+
+	return false
+}
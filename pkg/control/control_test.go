@@ -0,0 +1,55 @@
+package control_test
+
+import (
+	"github.com/dpvpro/deber/pkg/control"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const controlFile = `Source: foo
+Build-Depends: debhelper-compat (= 13),
+# comment in the middle
+ libbar-dev,
+ golang-go
+Standards-Version: 4.6.2
+
+Package: foo
+Architecture: any
+Description: short
+ long
+ .
+ description
+`
+
+func TestParse(t *testing.T) {
+	paragraphs, err := control.Parse(strings.NewReader(controlFile))
+	assert.NoError(t, err)
+	assert.Len(t, paragraphs, 2)
+
+	assert.Equal(t, "foo", paragraphs[0]["Source"])
+	assert.Equal(t, "debhelper-compat (= 13),\nlibbar-dev,\ngolang-go", paragraphs[0]["Build-Depends"])
+	assert.Equal(t, "any", paragraphs[1]["Architecture"])
+	assert.Equal(t, "short\nlong\n.\ndescription", paragraphs[1]["Description"])
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := control.Parse(strings.NewReader(" continuation\n"))
+	assert.Error(t, err)
+}
+
+func TestValidateRelations(t *testing.T) {
+	assert.NoError(t, control.ValidateRelations("debhelper-compat (= 13), libfoo-dev (>= 1.0~) [amd64 arm64] <!nocheck> | libbar-dev,\n python3:any,"))
+	assert.Error(t, control.ValidateRelations("libfoo-dev (>= 1.0"))
+	assert.Error(t, control.ValidateRelations("libfoo-dev (~ 1.0)"))
+}
+
+func TestMatchesArch(t *testing.T) {
+	assert.True(t, control.MatchesArch("any", "arm64"))
+	assert.True(t, control.MatchesArch("all", "arm64"))
+	assert.True(t, control.MatchesArch("amd64 arm64", "arm64"))
+	assert.True(t, control.MatchesArch("linux-any", "arm64"))
+	assert.True(t, control.MatchesArch("any-arm64", "arm64"))
+	assert.False(t, control.MatchesArch("amd64 i386", "arm64"))
+	assert.False(t, control.MatchesArch("kfreebsd-any", "arm64"))
+}
@@ -1,29 +1,34 @@
 package docker
 
 import (
-	"errors"
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/signal"
 	"slices"
 	"strings"
 	"syscall"
-
-	// "time"
+	"time"
 
 	// "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 
 	// "github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/pkg/stdcopy"
 	// "github.com/docker/docker/libnetwork/options"
 	"github.com/moby/term"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
 	// ContainerStopTimeout constant represents how long Docker Engine
-	// will wait for container before stopping it
-	ContainerStopTimeout = 2
+	// will wait for container before stopping it, by default
+	ContainerStopTimeout = time.Second
 
 	// ContainerStateRunning constants defines that container is running
 	ContainerStateRunning = "running"
@@ -42,10 +47,30 @@ const (
 // ContainerCreateArgs struct represents arguments
 // passed to ContainerCreate().
 type ContainerCreateArgs struct {
-	Mounts []mount.Mount
-	Image  string
-	Name   string
-	User   string
+	Mounts   []mount.Mount
+	Image    string
+	Name     string
+	User     string
+	Hostname string
+	DNS      []string
+	Labels   map[string]string
+	// Init runs Docker's init as PID 1, reaping zombie processes
+	Init bool
+	// ExtraHosts are added to /etc/hosts, as "name:ip"
+	ExtraHosts []string
+	// Runtime is OCI runtime of container, daemon's default if empty
+	Runtime string
+	// UsernsMode is user namespace of container, like "keep-id"
+	// of Podman, engine's default if empty
+	UsernsMode string
+	// Platform is platform of container, as "os/arch[/variant]",
+	// engine's default if empty
+	Platform string
+	// Memory is memory limit of container in bytes, none if 0
+	Memory int64
+	// NanoCPUs is CPU limit of container in billionths
+	// of CPU, none if 0
+	NanoCPUs int64
 }
 
 // ContainerExecArgs struct represents arguments
@@ -58,6 +83,24 @@ type ContainerExecArgs struct {
 	AsRoot      bool
 	Skip        bool
 	Network     bool
+	// Output is where command output is written instead of Stdout,
+	// if set, TTY is not allocated and stderr goes to ErrOutput
+	Output io.Writer
+	// ErrOutput is where stderr of command is written if Output is set,
+	// Stdout if empty, so it's logged like the rest of the build
+	ErrOutput io.Writer
+}
+
+// ExecError struct represents a command executed by ContainerExec()
+// that exited with non-zero status.
+type ExecError struct {
+	Cmd      string
+	ExitCode int
+}
+
+// Error function returns the failed command along with its exit code.
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("command %q exited with status %d", e.Cmd, e.ExitCode)
 }
 
 // IsContainerCreated function checks if container is created
@@ -124,14 +167,39 @@ func (docker *Docker) IsContainerStopped(name string) (bool, error) {
 // It's up to the caller to make to-be-mounted directories on host.
 func (docker *Docker) ContainerCreate(args ContainerCreateArgs) error {
 	hostConfig := &container.HostConfig{
-		Mounts: args.Mounts,
+		Mounts:     args.Mounts,
+		DNS:        args.DNS,
+		ExtraHosts: args.ExtraHosts,
+		Runtime:    args.Runtime,
+		UsernsMode: container.UsernsMode(args.UsernsMode),
+		Resources: container.Resources{
+			Memory:   args.Memory,
+			NanoCPUs: args.NanoCPUs,
+		},
+	}
+	if args.Init {
+		hostConfig.Init = &args.Init
 	}
 	config := &container.Config{
-		Image: args.Image,
-		User:  args.User,
+		Image:    args.Image,
+		User:     args.User,
+		Hostname: args.Hostname,
+		Labels:   args.Labels,
+	}
+
+	var platform *ocispec.Platform
+	if args.Platform != "" {
+		fields := strings.SplitN(args.Platform, "/", 3)
+		platform = &ocispec.Platform{OS: fields[0]}
+		if len(fields) > 1 {
+			platform.Architecture = fields[1]
+		}
+		if len(fields) > 2 {
+			platform.Variant = fields[2]
+		}
 	}
 
-	_, err := docker.cli.ContainerCreate(docker.ctx, config, hostConfig, nil, nil, args.Name)
+	_, err := docker.cli.ContainerCreate(docker.ctx, config, hostConfig, nil, platform, args.Name)
 	if err != nil {
 		return err
 	}
@@ -147,20 +215,61 @@ func (docker *Docker) ContainerStart(name string) error {
 
 // ContainerStop function stops container, just that.
 //
-// It utilizes ContainerStopTimeout constant.
+// Container is killed if it doesn't stop in StopTimeout.
 func (docker *Docker) ContainerStop(name string) error {
-	timeout := ContainerStopTimeout
+	timeout := int(math.Ceil(docker.StopTimeout.Seconds()))
 	options := container.StopOptions{Timeout: &timeout}
 
 	return docker.cli.ContainerStop(docker.ctx, name, options)
 }
 
-// ContainerRemove function removes container, just that.
-func (docker *Docker) ContainerRemove(name string) error {
-	options := container.RemoveOptions{}
+// ContainerRemove function removes container.
+//
+// Anonymous volumes associated with container are removed too,
+// if requested. Bind mounts and named volumes are never touched.
+func (docker *Docker) ContainerRemove(name string, removeVolumes bool) error {
+	options := container.RemoveOptions{
+		RemoveVolumes: removeVolumes,
+	}
 	return docker.cli.ContainerRemove(docker.ctx, name, options)
 }
 
+// ContainerExport function writes tarball
+// of container's filesystem to writer.
+func (docker *Docker) ContainerExport(name string, writer io.Writer) error {
+	reader, err := docker.cli.ContainerExport(docker.ctx, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	return reader.Close()
+}
+
+// ContainerLogs function writes last lines of container's logs,
+// all of them if tail is empty.
+func (docker *Docker) ContainerLogs(name, tail string, stdout, stderr io.Writer) error {
+	options := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       tail,
+	}
+
+	reader, err := docker.cli.ContainerLogs(docker.ctx, name, options)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = stdcopy.StdCopy(stdout, stderr, reader)
+	return err
+}
+
 // ContainerMounts returns mounts of created container.
 func (docker *Docker) ContainerMounts(name string) ([]mount.Mount, error) {
 	inspect, err := docker.cli.ContainerInspect(docker.ctx, name)
@@ -183,22 +292,38 @@ func (docker *Docker) ContainerMounts(name string) ([]mount.Mount, error) {
 	return mounts, nil
 }
 
+// ContainerLabels returns labels of created container.
+func (docker *Docker) ContainerLabels(name string) (map[string]string, error) {
+	inspect, err := docker.cli.ContainerInspect(docker.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if inspect.Config == nil {
+		return map[string]string{}, nil
+	}
+
+	return inspect.Config.Labels, nil
+}
+
 // ContainerExec function executes a command in running container.
-// Command is executed in bash shell by default.
+// Command is executed in bash shell by default, or in configured one.
+// Non-zero exit status is returned as *ExecError.
 // Command can be executed as root.
 // Command can be executed interactively.
-// Command can be empty, in that case just bash is executed.
+// Command can be empty, in that case just the shell is executed.
+// Command output can be captured instead of printed.
 func (docker *Docker) ContainerExec(args ContainerExecArgs) error {
 	config := container.ExecOptions{
-		Cmd:          []string{"bash"},
+		Cmd:          []string{docker.Shell},
 		WorkingDir:   args.WorkDir,
 		AttachStdin:  args.Interactive,
 		AttachStdout: true,
 		AttachStderr: true,
-		Tty:          true,
+		Tty:          args.Output == nil,
 	}
 	check := container.ExecAttachOptions{
-		Tty:    true,
+		Tty:    args.Output == nil,
 		Detach: false,
 	}
 
@@ -229,6 +354,10 @@ func (docker *Docker) ContainerExec(args ContainerExecArgs) error {
 		return err
 	}
 
+	// Hijacked connection outlives context, so it's closed on cancel
+	stop := context.AfterFunc(docker.ctx, hijack.Close)
+	defer stop()
+
 	if args.Interactive {
 		fd := os.Stdin.Fd()
 
@@ -244,13 +373,32 @@ func (docker *Docker) ContainerExec(args ContainerExecArgs) error {
 				return err
 			}
 
-			go docker.resizeIfChanged(response.ID, fd)
+			done := make(chan struct{})
+			defer close(done)
+
+			go docker.resizeIfChanged(response.ID, fd, done)
 			go io.Copy(hijack.Conn, os.Stdin)
 		}
 	}
 
-	io.Copy(os.Stdout, hijack.Conn)
+	if args.Output != nil {
+		errOutput := args.ErrOutput
+		if errOutput == nil {
+			errOutput = docker.Stdout
+		}
+		_, err = stdcopy.StdCopy(args.Output, errOutput, hijack.Reader)
+	} else if args.Interactive {
+		_, err = io.Copy(os.Stdout, hijack.Conn)
+	} else {
+		_, err = io.Copy(docker.Stdout, hijack.Conn)
+	}
 	hijack.Close()
+	if docker.ctx.Err() != nil {
+		return docker.ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
 
 	if !args.Interactive {
 		inspect, err := docker.cli.ContainerExecInspect(docker.ctx, response.ID)
@@ -259,20 +407,60 @@ func (docker *Docker) ContainerExec(args ContainerExecArgs) error {
 		}
 
 		if inspect.ExitCode != 0 {
-			return errors.New("command exited with non-zero status")
+			return &ExecError{
+				Cmd:      args.Cmd,
+				ExitCode: inspect.ExitCode,
+			}
 		}
 	}
 
 	return nil
 }
 
-func (docker *Docker) resizeIfChanged(execID string, fd uintptr) {
+// ContainerCopyFile function writes file with given content and mode
+// to directory in container. File is owned by root.
+func (docker *Docker) ContainerCopyFile(name, dir, file string, content []byte, mode int64) error {
+	buffer := new(bytes.Buffer)
+	writer := tar.NewWriter(buffer)
+	header := &tar.Header{
+		Name: file,
+		Size: int64(len(content)),
+		Mode: mode,
+	}
+
+	err := writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(content)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	options := container.CopyToContainerOptions{}
+	return docker.cli.CopyToContainer(docker.ctx, name, dir, buffer, options)
+}
+
+// resizeIfChanged function forwards terminal size changes
+// to exec process, until it's done.
+func (docker *Docker) resizeIfChanged(execID string, fd uintptr, done <-chan struct{}) {
 	channel := make(chan os.Signal, 1)
 	signal.Notify(channel, syscall.SIGWINCH)
+	defer signal.Stop(channel)
 
 	for {
-		<-channel
-		docker.ContainerExecResize(execID, fd)
+		select {
+		case <-channel:
+			docker.ContainerExecResize(execID, fd)
+		case <-done:
+			return
+		}
 	}
 }
 
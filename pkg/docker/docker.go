@@ -3,6 +3,12 @@ package docker
 
 import (
 	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/client"
 )
@@ -10,23 +16,149 @@ import (
 const (
 	// APIVersion constant is the minimum supported version of Docker Engine API
 	APIVersion = "1.45"
+
+	// UserNamespaceRootless constant represents Docker Engine running
+	// rootless, mapping root of containers to user who runs it
+	UserNamespaceRootless = "rootless"
+	// UserNamespaceRemap constant represents Docker Engine remapping
+	// users of containers to subordinate IDs (userns-remap)
+	UserNamespaceRemap = "userns"
 )
 
-// Docker struct represents Docker client.
+// Docker struct represents Docker client,
+// implementing Engine for Docker Engine.
 type Docker struct {
 	cli *client.Client
 	ctx context.Context
+
+	// Stdout is where output of commands and builds is written
+	Stdout io.Writer
+	// Shell executes commands in container and is launched
+	// interactively, if there is no command
+	Shell string
+	// StopTimeout is how long container is given to stop
+	// before it's killed
+	StopTimeout time.Duration
 }
 
-// New function creates fresh Docker struct and connects to Docker Engine.
-func New() (*Docker, error) {
-	cli, err := client.NewClientWithOpts(client.WithVersion(APIVersion))
+// newDocker function creates fresh Docker struct
+// connecting with given client options.
+func newDocker(args Args, opts ...client.Opt) (*Docker, error) {
+	cli, err := client.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Docker{
-		cli: cli,
-		ctx: context.Background(),
-	}, nil
+	docker := &Docker{
+		cli:         cli,
+		ctx:         context.Background(),
+		Stdout:      args.Stdout,
+		Shell:       args.Shell,
+		StopTimeout: args.StopTimeout,
+	}
+	if docker.Stdout == nil {
+		docker.Stdout = os.Stdout
+	}
+	if docker.Shell == "" {
+		docker.Shell = "bash"
+	}
+
+	return docker, nil
+}
+
+// Name function returns EngineDocker.
+func (docker *Docker) Name() string {
+	return EngineDocker
+}
+
+// WithTimeout function returns copy of Docker struct, whose requests
+// are cancelled once given timeout elapses, along with function
+// releasing its resources. Original one isn't affected.
+func (docker *Docker) WithTimeout(timeout time.Duration) (Engine, context.CancelFunc) {
+	return docker.withTimeout(timeout)
+}
+
+func (docker *Docker) withTimeout(timeout time.Duration) (*Docker, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(docker.ctx, timeout)
+
+	copied := *docker
+	copied.ctx = ctx
+
+	return &copied, cancel
+}
+
+// WithOutput function returns copy of Docker struct
+// writing output to given writer.
+func (docker *Docker) WithOutput(writer io.Writer) Engine {
+	return docker.withOutput(writer)
+}
+
+func (docker *Docker) withOutput(writer io.Writer) *Docker {
+	copied := *docker
+	copied.Stdout = writer
+
+	return &copied
+}
+
+// UsernsMode function returns engine's default, as rootless
+// Docker Engine already maps its root to user on host.
+func (docker *Docker) UsernsMode(string) string {
+	return ""
+}
+
+// TimedOut function checks if timeout of Docker struct
+// returned by WithTimeout() elapsed.
+func (docker *Docker) TimedOut() bool {
+	return errors.Is(docker.ctx.Err(), context.DeadlineExceeded)
+}
+
+// Runtimes function returns names of container runtimes
+// Docker Engine is configured with, sorted.
+func (docker *Docker) Runtimes() ([]string, error) {
+	info, err := docker.cli.Info(docker.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	runtimes := make([]string, 0, len(info.Runtimes))
+	for name := range info.Runtimes {
+		runtimes = append(runtimes, name)
+	}
+	slices.Sort(runtimes)
+
+	return runtimes, nil
+}
+
+// CPUs function returns number of CPUs
+// available to container engine.
+func (docker *Docker) CPUs() (int, error) {
+	info, err := docker.cli.Info(docker.ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.NCPU, nil
+}
+
+// UserNamespace function returns kind of user namespace
+// Docker Engine runs containers in, one of UserNamespace*
+// constants, or empty string if there is none.
+func (docker *Docker) UserNamespace() (string, error) {
+	info, err := docker.cli.Info(docker.ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, option := range info.SecurityOptions {
+		for _, field := range strings.Split(option, ",") {
+			switch field {
+			case "name=" + UserNamespaceRootless:
+				return UserNamespaceRootless, nil
+			case "name=" + UserNamespaceRemap:
+				return UserNamespaceRemap, nil
+			}
+		}
+	}
+
+	return "", nil
 }
@@ -0,0 +1,45 @@
+package docker_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEngine(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	podmanHost := "unix:///run/user/1000/podman/podman.sock"
+	if os.Geteuid() == 0 {
+		podmanHost = "unix:///run/podman/podman.sock"
+	}
+
+	tests := []struct {
+		engine     string
+		dockerHost string
+		name       string
+		host       string
+	}{
+		{docker.EngineDocker, "", docker.EngineDocker, client.DefaultDockerHost},
+		{docker.EngineDocker, "tcp://example.com:2375", docker.EngineDocker, client.DefaultDockerHost},
+		{docker.EnginePodman, "tcp://example.com:2375", docker.EnginePodman, podmanHost},
+		{"", "tcp://example.com:2375", docker.EngineDocker, "tcp://example.com:2375"},
+		{"", "unix:///run/user/1000/podman/podman.sock", docker.EnginePodman, "unix:///run/user/1000/podman/podman.sock"},
+	}
+
+	for _, test := range tests {
+		t.Setenv("DOCKER_HOST", test.dockerHost)
+
+		engine, err := docker.New(docker.Args{Engine: test.engine})
+		assert.NoError(t, err)
+		assert.Equal(t, test.name, engine.Name())
+		assert.Equal(t, test.host, docker.Host(engine), test)
+	}
+}
+
+func TestNewUnknownEngine(t *testing.T) {
+	_, err := docker.New(docker.Args{Engine: "lxc"})
+	assert.EqualError(t, err, "unknown container engine: lxc")
+}
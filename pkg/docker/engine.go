@@ -0,0 +1,210 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// EngineDocker constant represents Docker Engine
+	EngineDocker = "docker"
+	// EnginePodman constant represents Podman,
+	// reached through its Docker compatible API
+	EnginePodman = "podman"
+
+	// podmanKeepID constant is user namespace mode of rootless Podman
+	// mapping user on host to the same user ID in container
+	podmanKeepID = "keep-id"
+)
+
+// Engine interface represents container engine builds run in,
+// reached through Docker compatible API. Docker struct implements
+// Docker Engine, Podman struct implements Podman.
+type Engine interface {
+	// Name returns name of engine, one of Engine* constants
+	Name() string
+	// WithTimeout returns copy of engine whose requests are cancelled
+	// once given timeout elapses, along with function releasing it
+	WithTimeout(timeout time.Duration) (Engine, context.CancelFunc)
+	// WithOutput returns copy of engine writing output to given writer
+	WithOutput(writer io.Writer) Engine
+	// TimedOut checks if timeout of copy returned by WithTimeout() elapsed
+	TimedOut() bool
+
+	// Runtimes returns names of container runtimes engine has
+	Runtimes() ([]string, error)
+	// CPUs returns number of CPUs available to engine
+	CPUs() (int, error)
+	// UserNamespace returns kind of user namespace engine runs
+	// containers in, one of UserNamespace* constants or empty string
+	UserNamespace() (string, error)
+	// UsernsMode returns user namespace mode of containers running
+	// as user on host, given kind of user namespace engine runs
+	// containers in, empty string meaning engine's default
+	UsernsMode(userns string) string
+
+	IsImageBuilt(name string) (bool, error)
+	ImageAge(name string) (time.Duration, error)
+	ImageBuild(name string, dockerFile []byte, pullParent bool, labels map[string]string, platform string) error
+	ImagePull(ref string) error
+	ImagePush(ref string) error
+	ImageTag(name, tag string) error
+	ImageCreated(name string) (time.Time, error)
+	ImageLabels(name string) (map[string]string, error)
+	ImageDigest(name string) (string, error)
+	ImageImport(name string, source io.Reader) error
+	ImageSave(names []string, writer io.Writer) error
+	ImageLoad(reader io.Reader) ([]string, error)
+	ImageList(prefix string) ([]string, error)
+	ImageRemove(name string) error
+
+	IsContainerCreated(name string) (bool, error)
+	IsContainerStarted(name string) (bool, error)
+	IsContainerStopped(name string) (bool, error)
+	ContainerCreate(args ContainerCreateArgs) error
+	ContainerStart(name string) error
+	ContainerStop(name string) error
+	ContainerRemove(name string, removeVolumes bool) error
+	ContainerExport(name string, writer io.Writer) error
+	ContainerLogs(name, tail string, stdout, stderr io.Writer) error
+	ContainerMounts(name string) ([]mount.Mount, error)
+	ContainerLabels(name string) (map[string]string, error)
+	ContainerExec(args ContainerExecArgs) error
+	ContainerCopyFile(name, dir, file string, content []byte, mode int64) error
+	ContainerList(prefix string) ([]string, error)
+}
+
+// Args struct represents arguments passed to New().
+type Args struct {
+	// Engine is name of container engine, one of Engine* constants,
+	// detected if empty
+	Engine string
+	// Stdout is where output of commands and builds is written
+	Stdout io.Writer
+	// Shell executes commands in container and is launched
+	// interactively, if there is no command
+	Shell string
+	// StopTimeout is how long container is given to stop
+	// before it's killed
+	StopTimeout time.Duration
+}
+
+// New function connects to given container engine, or detected one
+// if empty. Only detected engine is reached through DOCKER_HOST.
+func New(args Args) (Engine, error) {
+	name, fromEnv := args.Engine, false
+	if name == "" {
+		name, fromEnv = detectEngine()
+	}
+
+	switch name {
+	case EngineDocker:
+		host := client.WithHost(client.DefaultDockerHost)
+		if fromEnv {
+			host = client.WithHostFromEnv()
+		}
+
+		docker, err := newDocker(args, host, client.WithVersion(APIVersion))
+		if err != nil {
+			return nil, err
+		}
+
+		return docker, nil
+	case EnginePodman:
+		host := client.WithHost("unix://" + podmanSocket())
+		if fromEnv {
+			host = client.WithHostFromEnv()
+		}
+
+		// API version is negotiated, as Podman lags behind Docker Engine
+		docker, err := newDocker(args, host, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return nil, err
+		}
+
+		return &Podman{docker}, nil
+	default:
+		return nil, fmt.Errorf("unknown container engine: %s", name)
+	}
+}
+
+// Podman struct represents Podman client. Podman is reached
+// through its Docker compatible API, so it differs from Docker
+// only where Podman itself does.
+type Podman struct {
+	*Docker
+}
+
+// Name function returns EnginePodman.
+func (podman *Podman) Name() string {
+	return EnginePodman
+}
+
+// WithTimeout function returns copy of Podman struct, whose requests
+// are cancelled once given timeout elapses, along with function
+// releasing its resources. Original one isn't affected.
+func (podman *Podman) WithTimeout(timeout time.Duration) (Engine, context.CancelFunc) {
+	docker, cancel := podman.withTimeout(timeout)
+
+	return &Podman{docker}, cancel
+}
+
+// WithOutput function returns copy of Podman struct
+// writing output to given writer.
+func (podman *Podman) WithOutput(writer io.Writer) Engine {
+	return &Podman{podman.withOutput(writer)}
+}
+
+// UsernsMode function returns keep-id for rootless Podman,
+// which maps user on host to the same user in container.
+func (podman *Podman) UsernsMode(userns string) string {
+	if userns == UserNamespaceRootless {
+		return podmanKeepID
+	}
+
+	return ""
+}
+
+// detectEngine function guesses container engine from DOCKER_HOST,
+// or sockets present, preferring Docker Engine if there are both.
+// Returns also if engine should be reached through DOCKER_HOST.
+func detectEngine() (string, bool) {
+	host := os.Getenv("DOCKER_HOST")
+	if host != "" {
+		if strings.Contains(host, EnginePodman) {
+			return EnginePodman, true
+		}
+		return EngineDocker, true
+	}
+
+	_, err := os.Stat(strings.TrimPrefix(client.DefaultDockerHost, "unix://"))
+	if err == nil {
+		return EngineDocker, false
+	}
+
+	_, err = os.Stat(podmanSocket())
+	if err == nil {
+		return EnginePodman, false
+	}
+
+	return EngineDocker, false
+}
+
+// podmanSocket function returns path of Podman's API socket,
+// rootless one for regular users.
+func podmanSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" && os.Geteuid() != 0 {
+		return filepath.Join(dir, "podman", "podman.sock")
+	}
+
+	return "/run/podman/podman.sock"
+}
@@ -0,0 +1,13 @@
+package docker
+
+// Host function returns address of given engine, for tests.
+func Host(engine Engine) string {
+	switch engine := engine.(type) {
+	case *Docker:
+		return engine.cli.DaemonHost()
+	case *Podman:
+		return engine.cli.DaemonHost()
+	default:
+		return ""
+	}
+}
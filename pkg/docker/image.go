@@ -3,14 +3,21 @@ package docker
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"time"
 
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/moby/term"
 )
@@ -44,7 +51,15 @@ func (docker *Docker) ImageAge(name string) (time.Duration, error) {
 
 // ImageBuild function build image from dockerfile
 // and prints output to Stdout.
-func (docker *Docker) ImageBuild(name string, dockerFile []byte) error {
+//
+// Parent image is pulled only if requested, so locally
+// imported images can be used as well.
+//
+// Given labels are applied to built image.
+//
+// Image is built for given platform, as "os/arch[/variant]",
+// or engine's default one if it's empty.
+func (docker *Docker) ImageBuild(name string, dockerFile []byte, pullParent bool, labels map[string]string, platform string) error {
 	buffer := new(bytes.Buffer)
 	writer := tar.NewWriter(buffer)
 	header := &tar.Header{
@@ -54,7 +69,9 @@ func (docker *Docker) ImageBuild(name string, dockerFile []byte) error {
 	options := types.ImageBuildOptions{
 		Tags:       []string{name},
 		Remove:     true,
-		PullParent: true,
+		PullParent: pullParent,
+		Labels:     labels,
+		Platform:   platform,
 	}
 
 	err := writer.WriteHeader(header)
@@ -78,7 +95,7 @@ func (docker *Docker) ImageBuild(name string, dockerFile []byte) error {
 	}
 
 	termFd, isTerm := term.GetFdInfo(os.Stdout)
-	err = jsonmessage.DisplayJSONMessagesStream(response.Body, os.Stdout, termFd, isTerm, nil)
+	err = jsonmessage.DisplayJSONMessagesStream(response.Body, docker.Stdout, termFd, isTerm, nil)
 	if err != nil {
 		return err
 	}
@@ -96,6 +113,211 @@ func (docker *Docker) ImageBuild(name string, dockerFile []byte) error {
 	return nil
 }
 
+// ImagePull function pulls image with given reference
+// and prints progress to Stdout.
+//
+// Credentials of registry are taken from Docker CLI config, if any.
+func (docker *Docker) ImagePull(ref string) error {
+	auth, err := registryAuth(ref)
+	if err != nil {
+		return err
+	}
+
+	response, err := docker.cli.ImagePull(docker.ctx, ref, image.PullOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+
+	termFd, isTerm := term.GetFdInfo(os.Stdout)
+	return jsonmessage.DisplayJSONMessagesStream(response, docker.Stdout, termFd, isTerm, nil)
+}
+
+// ImagePush function pushes image with given reference
+// and prints progress to Stdout.
+//
+// Credentials of registry are taken from Docker CLI config, if any.
+func (docker *Docker) ImagePush(ref string) error {
+	auth, err := registryAuth(ref)
+	if err != nil {
+		return err
+	}
+
+	response, err := docker.cli.ImagePush(docker.ctx, ref, image.PushOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+
+	termFd, isTerm := term.GetFdInfo(os.Stdout)
+	return jsonmessage.DisplayJSONMessagesStream(response, docker.Stdout, termFd, isTerm, nil)
+}
+
+// ImageTag function tags image with another name.
+func (docker *Docker) ImageTag(name, tag string) error {
+	return docker.cli.ImageTag(docker.ctx, name, tag)
+}
+
+// ImageCreated function returns creation time of image,
+// which is kept when it's pushed, pulled or tagged.
+func (docker *Docker) ImageCreated(name string) (time.Time, error) {
+	inspect, _, err := docker.cli.ImageInspectWithRaw(docker.ctx, name)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339Nano, inspect.Created)
+}
+
+// registryAuth function returns encoded credentials for registry
+// of given image reference, read from "auths" of Docker CLI config.
+//
+// Credential helpers are not supported, anonymous access
+// is used if there are no credentials stored in config.
+func registryAuth(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+
+	server := reference.Domain(named)
+	if server == "docker.io" {
+		server = "https://index.docker.io/v1/"
+	}
+
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return registry.EncodeAuthConfig(registry.AuthConfig{})
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	config := struct {
+		Auths map[string]registry.AuthConfig `json:"auths"`
+	}{}
+
+	content, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err == nil {
+		err = json.Unmarshal(content, &config)
+		if err != nil {
+			return "", fmt.Errorf("docker config: %w", err)
+		}
+	}
+
+	auth := config.Auths[server]
+	if auth.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", fmt.Errorf("docker config: %w", err)
+		}
+
+		auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		auth.Auth = ""
+	}
+	auth.ServerAddress = server
+
+	return registry.EncodeAuthConfig(auth)
+}
+
+// ImageLabels function returns labels of image with given name.
+func (docker *Docker) ImageLabels(name string) (map[string]string, error) {
+	inspect, _, err := docker.cli.ImageInspectWithRaw(docker.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if inspect.Config == nil {
+		return map[string]string{}, nil
+	}
+
+	return inspect.Config.Labels, nil
+}
+
+// ImageDigest function returns repository digest of image with
+// given name, or its ID if it wasn't pulled from any repository.
+func (docker *Docker) ImageDigest(name string) (string, error) {
+	inspect, _, err := docker.cli.ImageInspectWithRaw(docker.ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0], nil
+	}
+
+	return inspect.ID, nil
+}
+
+// ImageImport function creates image with given name
+// from root filesystem tarball read from source.
+func (docker *Docker) ImageImport(name string, source io.Reader) error {
+	importSource := image.ImportSource{
+		Source:     source,
+		SourceName: "-",
+	}
+
+	response, err := docker.cli.ImageImport(docker.ctx, importSource, name, image.ImportOptions{})
+	if err != nil {
+		return err
+	}
+
+	termFd, isTerm := term.GetFdInfo(os.Stdout)
+	err = jsonmessage.DisplayJSONMessagesStream(response, docker.Stdout, termFd, isTerm, nil)
+	if err != nil {
+		return err
+	}
+
+	return response.Close()
+}
+
+// ImageSave function writes images with given names
+// to writer, as tarball.
+func (docker *Docker) ImageSave(names []string, writer io.Writer) error {
+	reader, err := docker.cli.ImageSave(docker.ctx, names)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// ImageLoad function loads images from tarball read
+// from reader and returns their names.
+func (docker *Docker) ImageLoad(reader io.Reader) ([]string, error) {
+	response, err := docker.cli.ImageLoad(docker.ctx, reader, true)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	names := make([]string, 0)
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message jsonmessage.JSONMessage
+		err = decoder.Decode(&message)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if message.Error != nil {
+			return nil, message.Error
+		}
+
+		name, ok := strings.CutPrefix(strings.TrimSpace(message.Stream), "Loaded image: ")
+		if ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
 // ImageList returns a list of images that match passed criteria.
 func (docker *Docker) ImageList(prefix string) ([]string, error) {
 	images := make([]string, 0)
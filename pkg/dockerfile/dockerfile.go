@@ -3,6 +3,10 @@ package dockerfile
 
 import (
 	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
 	"text/template"
 
 	"github.com/dpvpro/deber/pkg/naming"
@@ -17,14 +21,52 @@ type Template struct {
 	Tag string
 	// SourceDir = /build/source
 	SourceDir string
+	// DefaultMirror is URL of archive in apt sources of parent image
+	DefaultMirror string
+	// Mirror is URL of archive used in place of default one,
+	// empty if default one is kept
+	Mirror string
+	// RequiredPackages are packages deber needs in image
+	RequiredPackages []string
+	// ExtraPackages are packages installed besides required ones
+	ExtraPackages []string
 }
 
+// Mirrors struct defines apt mirrors used in image
+// instead of default ones, per vendor.
+type Mirrors struct {
+	// Debian is URL of Debian archive mirror
+	Debian string
+	// Ubuntu is URL of Ubuntu archive mirror
+	Ubuntu string
+}
+
+const (
+	// DebianMirror constant is URL of Debian archive
+	// in apt sources of official images
+	DebianMirror = "http://deb.debian.org/debian"
+	// UbuntuMirror constant is URL of Ubuntu archive
+	// in apt sources of official images
+	UbuntuMirror = "http://archive.ubuntu.com/ubuntu"
+)
+
+var (
+	// DefaultPackages are installed in image besides required ones,
+	// unless removed by ImagePackages()
+	DefaultPackages = []string{"ranger", "neovim", "golang", "dh-golang", "git", "mc", "lf", "strace"}
+
+	// requiredPackages are needed by deber itself, so can't be removed
+	requiredPackages = []string{"build-essential", "devscripts", "debhelper", "lintian", "fakeroot", "dpkg-dev", "gnupg", "locales"}
+
+	packageRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+)
+
 const dockerfileTemplate = `
 # From which Docker image do we start?
 FROM {{ .Repo }}:{{ .Tag }}
 
 # Remove not needed apt configs.
-RUN rm /etc/apt/apt.conf.d/*
+RUN rm -f /etc/apt/apt.conf.d/*
 
 # Run apt without confirmations.
 RUN echo "APT::Get::Assume-Yes "true";" > /etc/apt/apt.conf.d/00noconfirm
@@ -32,14 +74,22 @@ RUN echo "APT::Get::Assume-Yes "true";" > /etc/apt/apt.conf.d/00noconfirm
 # Set debconf to be non interactive.
 RUN echo 'debconf debconf/frontend select Noninteractive' | debconf-set-selections
 
+{{- if .Mirror }}
+
+# Use apt mirror in place of default archive.
+RUN sed -i -E 's#{{ .DefaultMirror }}(/|[[:space:]]|$)#{{ .Mirror }}\1#g' $(find /etc/apt/sources.list /etc/apt/sources.list.d -type f)
+{{- end }}
+
 # Pin local repo (apt-get -t option pins with priority 990 too).
 RUN printf "Package: *\nPin: origin \"\"\nPin-Priority: 990\n" > /etc/apt/preferences.d/00a
 
 # Install required packages.
 RUN apt-get update && \
 	apt-get install --no-install-recommends -y \
-	build-essential devscripts debhelper lintian fakeroot dpkg-dev \
-	ranger neovim golang dh-golang git mc lf
+	{{ join .RequiredPackages " " }}
+{{- if .ExtraPackages }} \
+	{{ join .ExtraPackages " " }}
+{{- end }}
 
 # Set working directory.
 WORKDIR {{ .SourceDir }}
@@ -48,15 +98,30 @@ WORKDIR {{ .SourceDir }}
 CMD ["sleep", "inf"]
 `
 
-// Parse function returns ready to use template
-func Parse(repo, tag string) ([]byte, error) {
+// Parse function returns ready to use template.
+//
+// Mirror of vendor the repository belongs to replaces default
+// archive in apt sources, security archive is left as is.
+//
+// Given packages are installed besides required ones,
+// see ImagePackages().
+func Parse(repo, tag string, mirrors Mirrors, packages []string) ([]byte, error) {
 	t := Template{
-		Repo:      repo,
-		Tag:       tag,
-		SourceDir: naming.ContainerSourceDir,
+		Repo:             repo,
+		Tag:              tag,
+		SourceDir:        naming.ContainerSourceDir,
+		DefaultMirror:    DebianMirror,
+		Mirror:           mirrors.Debian,
+		RequiredPackages: requiredPackages,
+		ExtraPackages:    packages,
 	}
+	if isUbuntu(repo) {
+		t.DefaultMirror = UbuntuMirror
+		t.Mirror = mirrors.Ubuntu
+	}
+	t.Mirror = strings.TrimSuffix(t.Mirror, "/")
 
-	templ, err := template.New("dockerfile").Parse(dockerfileTemplate)
+	templ, err := template.New("dockerfile").Funcs(template.FuncMap{"join": strings.Join}).Parse(dockerfileTemplate)
 	if err != nil {
 		return nil, err
 	}
@@ -69,3 +134,36 @@ func Parse(repo, tag string) ([]byte, error) {
 
 	return buffer.Bytes(), nil
 }
+
+// isUbuntu function checks if repository holds Ubuntu images,
+// others, also bootstrapped ones, are assumed to be Debian.
+func isUbuntu(repo string) bool {
+	return repo == "ubuntu" || strings.HasSuffix(repo, "/ubuntu")
+}
+
+// ImagePackages function returns packages installed in image
+// besides required ones, that is default ones with given changes
+// applied. Names prefixed with "-" are removed, others added.
+func ImagePackages(changes []string) ([]string, error) {
+	packages := slices.Clone(DefaultPackages)
+
+	for _, change := range changes {
+		name, remove := strings.CutPrefix(change, "-")
+		if !packageRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid package name: %s", name)
+		}
+
+		switch {
+		case remove && slices.Contains(requiredPackages, name):
+			return nil, fmt.Errorf("package %s is required, it can't be removed", name)
+		case remove:
+			packages = slices.DeleteFunc(packages, func(pkg string) bool {
+				return pkg == name
+			})
+		case !slices.Contains(packages, name) && !slices.Contains(requiredPackages, name):
+			packages = append(packages, name)
+		}
+	}
+
+	return packages, nil
+}
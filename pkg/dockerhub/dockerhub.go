@@ -2,70 +2,279 @@
 package dockerhub
 
 import (
-	// "encoding/json"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"math/rand/v2"
 	"net/http"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cache      = make(map[string][]Tag)
+	cacheMutex sync.Mutex
+
+	// architectures maps Debian architectures to DockerHub namespaces
+	// holding official images built just for them, and platforms
+	architectures = map[string]struct{ namespace, platform string }{
+		"amd64":    {"amd64", "amd64"},
+		"arm64":    {"arm64v8", "arm64/v8"},
+		"armel":    {"arm32v5", "arm/v5"},
+		"armhf":    {"arm32v7", "arm/v7"},
+		"i386":     {"i386", "386"},
+		"mips64el": {"mips64le", "mips64le"},
+		"ppc64el":  {"ppc64le", "ppc64le"},
+		"riscv64":  {"riscv64", "riscv64"},
+		"s390x":    {"s390x", "s390x"},
+	}
+)
+
+// Tag struct represents tag of repository
+// along with platforms it has images for.
+type Tag struct {
+	Name   string  `json:"name"`
+	Images []Image `json:"images"`
+}
+
+// Image struct represents image of tag for single platform.
+type Image struct {
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant"`
+}
+
+// Supports function checks if tag has image for given platform.
+//
+// Variant is compared only if both platform and image have one.
+// Empty platform is supported by any tag.
+func (tag Tag) Supports(platform string) bool {
+	if platform == "" {
+		return true
+	}
+
+	architecture, variant, _ := strings.Cut(platform, "/")
+
+	return slices.ContainsFunc(tag.Images, func(image Image) bool {
+		if image.Architecture != architecture {
+			return false
+		}
+
+		return variant == "" || image.Variant == "" || image.Variant == variant
+	})
+}
+
+// Platform function returns DockerHub platform of images
+// for given Debian architecture, like "arm/v7" for armhf.
+func Platform(arch string) (string, error) {
+	architecture, ok := architectures[arch]
+	if !ok {
+		return "", fmt.Errorf("no official images for architecture %s", arch)
+	}
+
+	return architecture.platform, nil
+}
+
+// ArchRepos function returns repositories of official images
+// built just for given Debian architecture, like arm64v8/debian.
+func ArchRepos(repos []string, arch string) ([]string, error) {
+	architecture, ok := architectures[arch]
+	if !ok {
+		return nil, fmt.Errorf("no official images for architecture %s", arch)
+	}
+
+	archRepos := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		archRepos = append(archRepos, architecture.namespace+"/"+repo)
+	}
+
+	return archRepos, nil
+}
+
+// Options struct represents options of querying DockerHub API.
+type Options struct {
+	// Retries is how many times failed query is repeated
+	Retries int
+	// Delay is base delay before first retry, doubled with
+	// every next one, unless DockerHub asks for other one
+	Delay time.Duration
+	// Client is used to query API, default one if nil
+	Client *http.Client
+}
 
-	"github.com/thedevsaddam/gojsonq"
+const (
+	// DefaultRetries is number of retries GetTags() makes
+	DefaultRetries = 3
+	// DefaultDelay is base delay of retries GetTags() makes
+	DefaultDelay = time.Second
 )
 
+// page struct represents single page of tags listing.
+type page struct {
+	Next    string `json:"next"`
+	Results []Tag  `json:"results"`
+}
+
 // GetTags function queries DockerHub API for a list of all
+// available tags of a given repository, retrying with
+// default options.
+func GetTags(repo string) ([]Tag, error) {
+	return GetTagsWithOptions(repo, Options{
+		Retries: DefaultRetries,
+		Delay:   DefaultDelay,
+	})
+}
+
+// GetTagsWithOptions function queries DockerHub API for a list of all
 // available tags of a given repository.
 //
+// Repositories without namespace are official ones (library).
+//
 // https://stackoverflow.com/questions/48856693/dockerhub-api-listing-tags
 // curl -s GET 'https://hub.docker.com/v2/repositories/library/debian/tags?page_size=1000' | jq -r '.results|.[]|.name
-func GetTags(repo string) ([]string, error) {
+//
+// Listing is paginated, so pages are followed until the last one.
+// Queries failed due to network, rate limit (429) or server errors
+// are retried with exponential backoff and jitter, waiting as long
+// as Retry-After header says, if present.
+//
+// Tags are cached for the lifetime of the process.
+func GetTagsWithOptions(repo string, options Options) ([]Tag, error) {
+	// Lock isn't held while querying, not to hold up other repos
+	cacheMutex.Lock()
+	tags, ok := cache[repo]
+	cacheMutex.Unlock()
+	if ok {
+		return tags, nil
+	}
 
-	var tags []string
+	client := options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
 
-	url := fmt.Sprintf("https://hub.docker.com/v2/repositories/library/%s/tags?page_size=1000", repo)
+	path := repo
+	if !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
 
-	response, err := http.Get(url)
-	if err != nil {
-		return nil, err
+	url := fmt.Sprintf("https://hub.docker.com/v2/repositories/%s/tags?page_size=1000", path)
+
+	tags = make([]Tag, 0)
+	for url != "" {
+		p, err := getPageWithRetries(client, url, options)
+		if err != nil {
+			return nil, fmt.Errorf("listing tags of %s: %w", repo, err)
+		}
+
+		tags = append(tags, p.Results...)
+		url = p.Next
 	}
 
-	bytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+	cacheMutex.Lock()
+	cache[repo] = tags
+	cacheMutex.Unlock()
+
+	return tags, nil
+}
+
+// getPageWithRetries function fetches page from given URL,
+// retrying as described in GetTagsWithOptions().
+func getPageWithRetries(client *http.Client, url string, options Options) (page, error) {
+	delay := options.Delay
+
+	for attempt := 0; ; attempt++ {
+		p, wait, retry, err := getPage(client, url)
+		if err == nil {
+			return p, nil
+		}
+		if !retry || attempt >= options.Retries {
+			return page{}, err
+		}
+
+		if wait == 0 {
+			wait = delay + rand.N(delay/2+1)
+		}
+		time.Sleep(wait)
+		delay *= 2
 	}
+}
 
-	err = response.Body.Close()
+// getPage function fetches page from given URL.
+//
+// Returns also how long to wait before retrying, if DockerHub
+// says so, and whether failed query is worth retrying.
+func getPage(client *http.Client, url string) (page, time.Duration, bool, error) {
+	var p page
+
+	response, err := client.Get(url)
 	if err != nil {
-		return nil, err
+		return p, 0, true, err
 	}
+	defer response.Body.Close()
 
-	jsonRaw := string(bytes)
-
-	jq := gojsonq.New().FromString(jsonRaw)
-	if jq.Error() != nil {
-		return nil, err
+	if response.StatusCode != http.StatusOK {
+		retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError
+		return p, retryAfter(response.Header.Get("Retry-After")), retry, errors.New(response.Status)
 	}
 
-	res, err := jq.From("results").PluckR("name")
+	err = json.NewDecoder(response.Body).Decode(&p)
 	if err != nil {
-		return nil, err
+		return p, 0, false, err
 	}
 
-	tags, _ = res.StringSlice()
+	return p, 0, false, nil
+}
 
-	return tags, nil
+// retryAfter function parses Retry-After header value,
+// either in seconds or HTTP date. Zero is returned if
+// value is missing or invalid.
+func retryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(value)
+	if err == nil {
+		return max(time.Until(date), 0)
+	}
+
+	return 0
 }
 
 // MatchRepo returns repo which has the given tag
-func MatchRepo(repos []string, tag string) (string, error) {
+// with image for given platform, or any if it's empty.
+//
+// Repos can be ones built for single architecture,
+// as returned by ArchRepos().
+func MatchRepo(repos []string, tag, platform string) (string, error) {
+	unsupported := false
+
 	for _, repo := range repos {
 		tags, err := GetTags(repo)
 		if err != nil {
 			return "", err
 		}
 
-		if slices.Contains(tags, tag) {
+		i := slices.IndexFunc(tags, func(t Tag) bool {
+			return t.Name == tag
+		})
+		if i < 0 {
+			continue
+		}
+
+		if tags[i].Supports(platform) {
 			return repo, nil
 		}
+
+		unsupported = true
+	}
+
+	if unsupported {
+		return "", fmt.Errorf("tag %s has no image for %s", tag, platform)
 	}
 
 	return "", errors.New("couldn't match tag with repo")
@@ -0,0 +1,123 @@
+package dockerhub_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/dockerhub"
+	"github.com/stretchr/testify/assert"
+)
+
+// transport serves canned responses by request URL.
+type transport map[string]string
+
+func (t transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, ok := t[request.URL.String()]
+	if !ok {
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Status:     "404 Not Found",
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    request,
+		}, nil
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    request,
+	}, nil
+}
+
+// sequence serves given responses one after another,
+// counting requests.
+type sequence struct {
+	responses []*http.Response
+	requests  int
+}
+
+func (s *sequence) RoundTrip(request *http.Request) (*http.Response, error) {
+	response := s.responses[min(s.requests, len(s.responses)-1)]
+	s.requests++
+
+	response.Request = request
+	response.Body = io.NopCloser(strings.NewReader(`{"next": null, "results": [{"name": "unstable"}]}`))
+	if response.Header == nil {
+		response.Header = make(http.Header)
+	}
+
+	return response, nil
+}
+
+func status(code int) *http.Response {
+	return &http.Response{StatusCode: code, Status: fmt.Sprintf("%d %s", code, http.StatusText(code))}
+}
+
+func TestGetTagsPaginated(t *testing.T) {
+	first := "https://hub.docker.com/v2/repositories/test/paginated/tags?page_size=1000"
+	second := "https://hub.docker.com/v2/repositories/test/paginated/tags?page=2&page_size=1000"
+
+	client := &http.Client{
+		Transport: transport{
+			first:  `{"next": "` + second + `", "results": [{"name": "unstable"}, {"name": "trixie"}]}`,
+			second: `{"next": null, "results": [{"name": "bookworm"}]}`,
+		},
+	}
+
+	tags, err := dockerhub.GetTagsWithOptions("test/paginated", dockerhub.Options{Client: client})
+	assert.NoError(t, err)
+
+	names := make([]string, 0)
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+
+	assert.Equal(t, []string{"unstable", "trixie", "bookworm"}, names)
+}
+
+func TestGetTagsNotFound(t *testing.T) {
+	client := &http.Client{Transport: transport{}}
+
+	_, err := dockerhub.GetTagsWithOptions("test/missing", dockerhub.Options{Retries: 3, Client: client})
+	assert.EqualError(t, err, "listing tags of test/missing: 404 Not Found")
+}
+
+func TestGetTagsRetried(t *testing.T) {
+	for _, code := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusBadGateway} {
+		s := &sequence{responses: []*http.Response{status(code), status(code), status(http.StatusOK)}}
+		options := dockerhub.Options{Retries: 3, Delay: time.Millisecond, Client: &http.Client{Transport: s}}
+
+		tags, err := dockerhub.GetTagsWithOptions("test/retried-"+http.StatusText(code), options)
+		assert.NoError(t, err)
+		assert.Len(t, tags, 1)
+		assert.Equal(t, 3, s.requests)
+	}
+}
+
+func TestGetTagsRetryAfter(t *testing.T) {
+	limited := status(http.StatusTooManyRequests)
+	limited.Header = http.Header{"Retry-After": {"1"}}
+
+	s := &sequence{responses: []*http.Response{limited, status(http.StatusOK)}}
+	options := dockerhub.Options{Retries: 3, Delay: time.Millisecond, Client: &http.Client{Transport: s}}
+
+	begin := time.Now()
+	_, err := dockerhub.GetTagsWithOptions("test/retry-after", options)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(begin), time.Second)
+	assert.Equal(t, 2, s.requests)
+}
+
+func TestGetTagsGivesUp(t *testing.T) {
+	s := &sequence{responses: []*http.Response{status(http.StatusServiceUnavailable)}}
+	options := dockerhub.Options{Retries: 2, Delay: time.Millisecond, Client: &http.Client{Transport: s}}
+
+	_, err := dockerhub.GetTagsWithOptions("test/unavailable", options)
+	assert.EqualError(t, err, "listing tags of test/unavailable: 503 Service Unavailable")
+	assert.Equal(t, 3, s.requests)
+}
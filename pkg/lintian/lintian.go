@@ -0,0 +1,97 @@
+// Package lintian includes lintian output parsing utilities
+package lintian
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	// SeverityError constant represents error tags
+	SeverityError = "E"
+	// SeverityWarning constant represents warning tags
+	SeverityWarning = "W"
+	// SeverityInfo constant represents info tags
+	SeverityInfo = "I"
+	// SeverityPedantic constant represents pedantic tags
+	SeverityPedantic = "P"
+)
+
+// severities are ordered from the most to the least severe
+var severities = []string{SeverityError, SeverityWarning, SeverityInfo, SeverityPedantic}
+
+// Tag struct represents single tag emitted by lintian.
+type Tag struct {
+	Name     string `json:"tag"`
+	Severity string `json:"severity"`
+	Package  string `json:"package"`
+	Info     string `json:"info"`
+}
+
+// Parse function extracts tags from lintian output.
+//
+// Lines not looking like tags, overridden and
+// experimental ones are ignored.
+func Parse(output string) []Tag {
+	tags := make([]Tag, 0)
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		// E: package: tag-name extra info
+		severity, rest, ok := strings.Cut(line, ": ")
+		if !ok || !slices.Contains(severities, severity) {
+			continue
+		}
+
+		pkg, rest, ok := strings.Cut(rest, ": ")
+		if !ok {
+			continue
+		}
+
+		name, info, _ := strings.Cut(rest, " ")
+
+		tag := Tag{
+			Severity: severity,
+			Package:  pkg,
+			Name:     name,
+			Info:     info,
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// IsSeverity function checks if given string is a known severity.
+func IsSeverity(severity string) bool {
+	return slices.Contains(severities, severity)
+}
+
+// Without function returns tags other than the ones with given names.
+func Without(tags []Tag, names []string) []Tag {
+	filtered := make([]Tag, 0)
+
+	for _, tag := range tags {
+		if !slices.Contains(names, tag.Name) {
+			filtered = append(filtered, tag)
+		}
+	}
+
+	return filtered
+}
+
+// AtLeast function returns tags with severity equal to
+// or more severe than given one.
+func AtLeast(tags []Tag, severity string) []Tag {
+	threshold := slices.Index(severities, severity)
+	filtered := make([]Tag, 0)
+
+	for _, tag := range tags {
+		if slices.Index(severities, tag.Severity) <= threshold {
+			filtered = append(filtered, tag)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,64 @@
+package lintian_test
+
+import (
+	"encoding/json"
+	"github.com/dpvpro/deber/pkg/lintian"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const output = `E: foo: binary-without-manpage usr/bin/foo
+W: foo source: ancient-standards-version 3.9.8 (released 2016-04-06) (current is 4.6.2)
+I: foo: spelling-error-in-description teh the
+N: some note that is not a tag
+O: foo: overridden-tag
+`
+
+func TestParse(t *testing.T) {
+	tags := lintian.Parse(output)
+
+	assert.Equal(t, []lintian.Tag{
+		{
+			Severity: "E",
+			Package:  "foo",
+			Name:     "binary-without-manpage",
+			Info:     "usr/bin/foo",
+		}, {
+			Severity: "W",
+			Package:  "foo source",
+			Name:     "ancient-standards-version",
+			Info:     "3.9.8 (released 2016-04-06) (current is 4.6.2)",
+		}, {
+			Severity: "I",
+			Package:  "foo",
+			Name:     "spelling-error-in-description",
+			Info:     "teh the",
+		},
+	}, tags)
+}
+
+func TestAtLeast(t *testing.T) {
+	tags := lintian.Parse(output)
+
+	assert.Len(t, lintian.AtLeast(tags, lintian.SeverityError), 1)
+	assert.Len(t, lintian.AtLeast(tags, lintian.SeverityWarning), 2)
+	assert.Len(t, lintian.AtLeast(tags, lintian.SeverityInfo), 3)
+}
+
+func TestWithout(t *testing.T) {
+	tags := lintian.Parse(output)
+
+	filtered := lintian.Without(tags, []string{"binary-without-manpage", "no-such-tag"})
+
+	assert.Len(t, filtered, 2)
+	assert.Equal(t, "ancient-standards-version", filtered[0].Name)
+}
+
+func TestTagJSON(t *testing.T) {
+	tags := lintian.Parse(output)
+
+	report, err := json.Marshal(tags[:1])
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"tag":"binary-without-manpage","severity":"E","package":"foo","info":"usr/bin/foo"}]`, string(report))
+}
@@ -2,15 +2,19 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 const (
 	cyan   = "\033[0;36m"
 	blue   = "\033[0;34m"
 	red    = "\033[0;31m"
+	yellow = "\033[0;33m"
 	normal = "\033[0m"
 )
 
@@ -18,76 +22,309 @@ var (
 	// NoColor controls if log will be colored or not
 	NoColor bool
 	// Prefix is the program name, will be outputted before info messages
-	Prefix  string
-	dropped bool
+	Prefix string
+	// Output is where log is written, along with output of commands
+	Output io.Writer = os.Stdout
+	// mutex guards output of concurrent builds
+	mutex sync.Mutex
+
+	// std is logger of package level functions, writing untagged
+	// lines to Output as they come
+	std = &Logger{Output: outputWriter{}}
+	// loggers are loggers of concurrent builds, see Register()
+	loggers = make(map[string]*Logger)
 )
 
 func init() {
 	Prefix = filepath.Base(os.Args[0])
 }
 
-// Drop function prints new line
-func Drop() {
-	if dropped {
+// Logger struct represents log of single build.
+//
+// Lines of logger with tag are prefixed with it and written
+// to Output only once complete, so lines of concurrent builds
+// don't interleave and steps stay on their own lines.
+type Logger struct {
+	// Output is where output of commands of build is written,
+	// tagged line by line like the log
+	Output io.Writer
+
+	tag     string
+	dropped bool
+	// line is pending line of log, output is pending line
+	// of commands, both used only if there is a tag
+	line   []byte
+	output []byte
+}
+
+// New function returns logger prefixing lines with given tag.
+func New(tag string) *Logger {
+	logger := &Logger{tag: tag}
+	logger.Output = lineWriter{logger}
+
+	return logger
+}
+
+// Register function makes given logger used by For()
+// for given key, like name of container of the build.
+func Register(key string, logger *Logger) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	loggers[key] = logger
+}
+
+// Unregister function removes logger registered for given key,
+// writing out its pending lines.
+func Unregister(key string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger, ok := loggers[key]
+	if !ok {
 		return
 	}
 
-	dropped = true
-	fmt.Println()
+	logger.writeTagged(logger.output)
+	logger.output = nil
+	logger.drop()
+	delete(loggers, key)
+}
+
+// For function returns logger registered for given key,
+// or one of package level functions if there is none.
+func For(key string) *Logger {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger, ok := loggers[key]
+	if !ok {
+		return std
+	}
+
+	return logger
+}
+
+// Tee function makes log written also to given writer,
+// besides current output.
+func Tee(writer io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	Output = io.MultiWriter(Output, writer)
+}
+
+// Drop function prints new line
+func Drop() {
+	std.Drop()
 }
 
 // Info function prints given string
 func Info(info string) {
-	dropped = false
+	std.Info(info)
+}
+
+// Error function prints given error
+func Error(err error) {
+	std.Error(err)
+}
+
+// Warning function prints given error, which isn't fatal,
+// on its own line
+func Warning(err error) {
+	std.Warning(err)
+}
+
+// ExtraInfo prints given info with indent and without colors or prefix
+func ExtraInfo(info string) {
+	std.ExtraInfo(info)
+}
+
+// Skipped function prints 'skipped' and new line
+func Skipped() error {
+	return std.Skipped()
+}
+
+// Done function prints 'done' and new line
+func Done() error {
+	return std.Done()
+}
+
+// Failed function prints 'failed' and new line
+func Failed(err error) error {
+	return std.Failed(err)
+}
+
+// Drop function prints new line
+func (logger *Logger) Drop() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.drop()
+}
+
+// Info function prints given string
+func (logger *Logger) Info(info string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.dropped = false
 
 	if NoColor {
-		fmt.Printf("%s:info: %s ... ", Prefix, info)
+		logger.write(fmt.Sprintf("%s:info: %s ... ", Prefix, info))
 	} else {
-		fmt.Printf("%s%s:info:%s %s ... ", blue, Prefix, normal, info)
+		logger.write(fmt.Sprintf("%s%s:info:%s %s ... ", blue, Prefix, normal, info))
 	}
 }
 
 // Error function prints given error
-func Error(err error) {
+func (logger *Logger) Error(err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if NoColor {
+		logger.write(fmt.Sprintf("%s:error: %s", Prefix, err))
+	} else {
+		logger.write(fmt.Sprintf("%s%s:error:%s %s", red, Prefix, normal, err))
+	}
+	logger.endLine()
+}
+
+// Warning function prints given error, which isn't fatal,
+// on its own line
+func (logger *Logger) Warning(err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.drop()
+
 	if NoColor {
-		fmt.Printf("%s:error: %s\n", Prefix, err)
+		logger.write(fmt.Sprintf("%s:warning: %s", Prefix, err))
 	} else {
-		fmt.Printf("%s%s:error:%s %s\n", red, Prefix, normal, err)
+		logger.write(fmt.Sprintf("%s%s:warning:%s %s", yellow, Prefix, normal, err))
 	}
+	logger.endLine()
 }
 
 // ExtraInfo prints given info with indent and without colors or prefix
-func ExtraInfo(info string) {
-	dropped = false
-	fmt.Printf("  %s ... ", info)
+func (logger *Logger) ExtraInfo(info string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.dropped = false
+	logger.write(fmt.Sprintf("  %s ... ", info))
 }
 
 // Skipped function prints 'skipped' and new line
-func Skipped() error {
-	if !dropped {
-		fmt.Printf("%s", "skipped")
-		Drop()
+func (logger *Logger) Skipped() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !logger.dropped {
+		logger.write("skipped")
+		logger.drop()
 	}
 
 	return nil
 }
 
 // Done function prints 'done' and new line
-func Done() error {
-	if !dropped {
-		fmt.Printf("%s", "done")
-		Drop()
+func (logger *Logger) Done() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !logger.dropped {
+		logger.write("done")
+		logger.drop()
 	}
 
 	return nil
 }
 
 // Failed function prints 'failed' and new line
-func Failed(err error) error {
-	if !dropped {
-		fmt.Printf("%s", "failed")
-		Drop()
+func (logger *Logger) Failed(err error) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !logger.dropped {
+		logger.write("failed")
+		logger.drop()
 	}
 
 	return err
 }
+
+func (logger *Logger) drop() {
+	if logger.dropped {
+		return
+	}
+
+	logger.dropped = true
+	logger.endLine()
+}
+
+// write function writes text to Output, or adds it
+// to pending line if there is a tag.
+func (logger *Logger) write(text string) {
+	if logger.tag == "" {
+		fmt.Fprint(Output, text)
+		return
+	}
+
+	logger.line = append(logger.line, text...)
+}
+
+// endLine function ends current line, writing it
+// out if it was pending.
+func (logger *Logger) endLine() {
+	if logger.tag == "" {
+		fmt.Fprintln(Output)
+		return
+	}
+
+	logger.writeTagged(logger.line)
+	logger.line = logger.line[:0]
+}
+
+// writeTagged function writes given line to Output,
+// prefixed with tag.
+func (logger *Logger) writeTagged(line []byte) {
+	if len(line) == 0 {
+		return
+	}
+
+	fmt.Fprintf(Output, "[%s] %s\n", logger.tag, bytes.TrimRight(line, "\r"))
+}
+
+// outputWriter struct writes to current Output,
+// even if it's replaced later.
+type outputWriter struct{}
+
+func (outputWriter) Write(p []byte) (int, error) {
+	return Output.Write(p)
+}
+
+// lineWriter struct writes output of commands
+// to Output as tagged lines of logger.
+type lineWriter struct {
+	logger *Logger
+}
+
+func (writer lineWriter) Write(p []byte) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger := writer.logger
+	logger.output = append(logger.output, p...)
+	for {
+		i := bytes.IndexByte(logger.output, '\n')
+		if i < 0 {
+			break
+		}
+
+		logger.writeTagged(logger.output[:i])
+		logger.output = logger.output[i+1:]
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,37 @@
+package log_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggersDontInterleave(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	output := log.Output
+	log.Output = buffer
+	log.NoColor = true
+	log.Prefix = "deber"
+	defer func() { log.Output = output }()
+
+	first := log.New("unstable")
+	second := log.New("bookworm")
+	log.Register("first", first)
+	log.Register("second", second)
+
+	log.For("first").Info("Building image")
+	log.For("second").Info("Building image")
+	fmt.Fprint(log.For("second").Output, "Step 1/8\nStep 2")
+	_ = log.For("first").Done()
+	_ = log.For("second").Failed(nil)
+	log.Unregister("first")
+	log.Unregister("second")
+
+	assert.Equal(t, "[bookworm] Step 1/8\n"+
+		"[unstable] deber:info: Building image ... done\n"+
+		"[bookworm] deber:info: Building image ... failed\n"+
+		"[bookworm] Step 2\n", buffer.String())
+}
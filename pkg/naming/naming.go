@@ -17,9 +17,27 @@ const (
 	// ContainerSourceDir constant represents where on container will
 	// source directory be mounted
 	ContainerSourceDir = "/build/source"
+	// ContainerSourceDebianDir constant represents where on container will
+	// debian directory of source be mounted, when source is read-only
+	ContainerSourceDebianDir = "/source-debian"
+	// ContainerSourceCopyDir constant represents where on container will
+	// source directory be mounted, when it's copied to build directory
+	ContainerSourceCopyDir = "/source-copy"
+	// ContainerLanguageCacheDir constant represents where on container will
+	// persistent caches of language package managers be mounted
+	ContainerLanguageCacheDir = "/language-cache"
 	// ContainerCacheDir constant represents where on container will
 	// cache directory be mounted
 	ContainerCacheDir = "/var/cache/apt"
+	// ContainerSourcesListFile constant represents where on container will
+	// custom apt sources list be mounted
+	ContainerSourcesListFile = "/etc/apt/sources.list"
+	// ContainerGnupgDir constant represents where on container will
+	// host's GnuPG home directory be mounted
+	ContainerGnupgDir = "/gnupg"
+	// ContainerGpgAgentSocket constant represents where on container will
+	// host's GPG agent socket be mounted
+	ContainerGpgAgentSocket = "/run/gpg-agent"
 )
 
 // Naming struct holds various information naming information
@@ -32,6 +50,9 @@ type Naming struct {
 	Container string
 	// Image name
 	Image string
+	// VersionNoEpoch is version of source package without epoch,
+	// as in names of built files
+	VersionNoEpoch string
 
 	// SourceDir is an absolute path where source lives
 	SourceDir string
@@ -68,6 +89,9 @@ type Args struct {
 	Upstream string
 	// Target is the target distribution the package is building for
 	Target string
+	// Arch is the architecture the package is building for,
+	// if it's not the host one
+	Arch string
 
 	// SourceBaseDir is a directory where source lives
 	SourceBaseDir string
@@ -84,14 +108,23 @@ func New(args Args) *Naming {
 	args.Target = standardizeTarget(args.Version, args.Target)
 
 	version := standardizeVersion(args.Version)
-	image := fmt.Sprintf("%s:%s", args.Prefix, args.Target)
-	container := fmt.Sprintf("%s_%s_%s_%s", args.Prefix, args.Target, args.Source, version)
+	versionNoEpoch := args.Version
+	if _, v, ok := strings.Cut(versionNoEpoch, ":"); ok {
+		versionNoEpoch = v
+	}
+	tag := args.Target
+	if args.Arch != "" {
+		tag += "-" + args.Arch
+	}
+	image := fmt.Sprintf("%s:%s", args.Prefix, tag)
+	container := fmt.Sprintf("%s_%s_%s_%s", args.Prefix, tag, args.Source, version)
 
 	return &Naming{
 		Args: args,
 
-		Container: container,
-		Image:     image,
+		Container:      container,
+		Image:          image,
+		VersionNoEpoch: versionNoEpoch,
 
 		SourceDir:          args.SourceBaseDir,
 		SourceParentDir:    filepath.Dir(args.SourceBaseDir),
@@ -0,0 +1,152 @@
+package steps
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+// Archive function moves successful build to archive if files changed.
+func Archive(n *naming.Naming, umask string) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Archiving build")
+
+	mask := os.FileMode(0)
+	if umask != "" {
+		var err error
+		mask, err = parseUmask(umask)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	// Make needed directories
+	err := os.MkdirAll(n.PackagesVersionDir, os.ModePerm)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	// Read files in build directory
+	files, err := os.ReadDir(n.BuildDir)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	logger.Drop()
+
+	for _, f := range files {
+		// We don't need directories, only files
+		if f.IsDir() {
+			continue
+		}
+
+		sourcePath := filepath.Join(n.BuildDir, f.Name())
+
+		info := f.Name()
+		if uid, ok := fileOwner(sourcePath); ok && uid != os.Getuid() {
+			info += fmt.Sprintf(", written by user %d in build directory", uid)
+		}
+		logger.ExtraInfo(info)
+
+		targetPath := filepath.Join(n.PackagesVersionDir, f.Name())
+
+		sourceStat, err := os.Stat(sourcePath)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		// Check if the same file is already archived,
+		// comparing checksums only if sizes are equal
+		targetStat, _ := os.Stat(targetPath)
+		if targetStat != nil && targetStat.Size() == sourceStat.Size() {
+			sourceChecksum, err := fileChecksum(sourcePath)
+			if err != nil {
+				return logger.Failed(err)
+			}
+
+			targetChecksum, err := fileChecksum(targetPath)
+			if err != nil {
+				return logger.Failed(err)
+			}
+
+			// if equal then simply skip copying this file
+			if targetChecksum == sourceChecksum {
+				_ = logger.Skipped()
+				continue
+			}
+		}
+
+		// Target file doesn't exist or differs
+		err = copyFile(sourcePath, targetPath)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		// Mode of replaced file would be kept otherwise
+		err = os.Chmod(targetPath, sourceStat.Mode().Perm()&^mask)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		_ = logger.Done()
+	}
+
+	logger.Drop()
+	return logger.Done()
+}
+
+// fileChecksum function returns MD5 checksum of file,
+// reading it in chunks.
+func fileChecksum(path string) ([md5.Size]byte, error) {
+	var checksum [md5.Size]byte
+
+	file, err := os.Open(path)
+	if err != nil {
+		return checksum, err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return checksum, err
+	}
+
+	copy(checksum[:], hash.Sum(nil))
+
+	return checksum, nil
+}
+
+// fileOwner function returns ID of user owning file,
+// if it can be determined.
+func fileOwner(path string) (int, bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return int(stat.Uid), true
+}
+
+// parseUmask function parses octal umask.
+func parseUmask(umask string) (os.FileMode, error) {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid umask: %s", umask)
+	}
+
+	return os.FileMode(mask), nil
+}
@@ -0,0 +1,460 @@
+package steps
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/dockerfile"
+	"github.com/dpvpro/deber/pkg/dockerhub"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+var (
+	// images are checked (and built if needed) once per run,
+	// and only one build of the same image runs at a time
+	images      = make(map[string]*imageState)
+	imagesMutex sync.Mutex
+)
+
+// BuildArgs struct represents arguments
+// passed to Build().
+type BuildArgs struct {
+	// MaxAge is age after which image is rebuilt
+	MaxAge time.Duration
+	// ImageFrom is where parent image comes from,
+	// ImageFromDockerHub or ImageFromDebootstrap
+	ImageFrom string
+	// Repos are DockerHub repositories parent image is looked for in
+	Repos []string
+	// Labels are additional labels of image
+	Labels map[string]string
+	// Offline uses existing image without reaching the network
+	Offline bool
+	// Mirrors are apt mirrors replacing default archives in image
+	Mirrors dockerfile.Mirrors
+	// Packages are installed in image besides required ones
+	Packages []string
+	// Cache is registry repository images are shared through,
+	// tagged with their content hash, not used if empty
+	Cache string
+}
+
+// Build function determines parent image name by querying DockerHub API
+// for available tags of given repositories (like "debian" and "ubuntu")
+// and confronting them with debian/changelog's target distribution.
+//
+// If image exists and is old enough, it will be rebuilt.
+//
+// At last it commands Docker Engine to build image.
+func Build(dock docker.Engine, n *naming.Naming, buildArgs BuildArgs) error {
+	logger := log.For(n.Container)
+
+	state := lockImage(n.Image)
+	defer state.mutex.Unlock()
+
+	if state.ready {
+		logger.Info("Building image")
+		return logger.Skipped()
+	}
+
+	err := build(dock, n, buildArgs)
+	if err != nil {
+		return err
+	}
+
+	state.ready = true
+
+	return nil
+}
+
+// imageState struct represents state of image in current run.
+type imageState struct {
+	mutex sync.Mutex
+	ready bool
+}
+
+// lockImage function locks and returns state of image with given name.
+func lockImage(name string) *imageState {
+	imagesMutex.Lock()
+	state, ok := images[name]
+	if !ok {
+		state = new(imageState)
+		images[name] = state
+	}
+	imagesMutex.Unlock()
+
+	state.mutex.Lock()
+
+	return state
+}
+
+// build function does the actual work of Build().
+func build(dock docker.Engine, n *naming.Naming, buildArgs BuildArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Building image")
+
+	isImageBuilt, err := dock.IsImageBuilt(n.Image)
+	if err != nil {
+		return logger.Failed(err)
+	}
+	if buildArgs.Offline {
+		if isImageBuilt {
+			return logger.Skipped()
+		}
+		return logger.Failed(fmt.Errorf("image %s has to be built, which is not possible offline", n.Image))
+	}
+	if isImageBuilt {
+		age, err := dock.ImageAge(n.Image)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		labels, err := dock.ImageLabels(n.Image)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		// Images without checksum label are of unknown origin
+		hash, isLabeled := labels[LabelDockerfileHash]
+
+		isCurrent, err := isDockerfileCurrent(labels[LabelParent], n.Target, hash, buildArgs.Mirrors, buildArgs.Packages)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		if age < buildArgs.MaxAge && isLabeled && isCurrent {
+			return logger.Skipped()
+		}
+	}
+
+	var repo string
+	var pullParent bool
+
+	switch buildArgs.ImageFrom {
+	case ImageFromDockerHub:
+		repos := buildArgs.Repos
+		if n.Arch != "" {
+			repos, err = dockerhub.ArchRepos(repos, n.Arch)
+			if err != nil {
+				return logger.Failed(err)
+			}
+		}
+
+		platform, err := imagePlatform(n.Arch)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		repo, err = dockerhub.MatchRepo(repos, n.Target, platform)
+		if err != nil {
+			return logger.Failed(err)
+		}
+		pullParent = true
+	case ImageFromDebootstrap:
+		if n.Arch != "" {
+			return logger.Failed(errors.New("debootstrap can't bootstrap image for other architecture"))
+		}
+
+		logger.Drop()
+
+		repo = n.Prefix + "-" + ImageFromDebootstrap
+		err = debootstrap(dock, logger, repo+":"+n.Target, n.Target)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	default:
+		return logger.Failed(fmt.Errorf("unknown image source: %s", buildArgs.ImageFrom))
+	}
+
+	dockerFile, err := dockerfile.Parse(repo, n.Target, buildArgs.Mirrors, buildArgs.Packages)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	labels := map[string]string{
+		LabelParent:         repo + ":" + n.Target,
+		LabelDockerfileHash: fmt.Sprintf("%x", sha256.Sum256(dockerFile)),
+		LabelTarget:         n.Target,
+	}
+	for key, value := range buildArgs.Labels {
+		labels[key] = value
+	}
+
+	logger.Drop()
+
+	cached := ""
+	if buildArgs.Cache != "" {
+		cached, err = cachedImageName(dock, buildArgs.Cache, repo+":"+n.Target, pullParent, dockerFile)
+		if err != nil {
+			return logger.Failed(err)
+		}
+		pullParent = false
+
+		isPulled, err := pullCachedImage(dock, logger, cached, n.Image, buildArgs.MaxAge)
+		if err != nil {
+			return logger.Failed(err)
+		}
+		if isPulled {
+			logger.ExtraInfo("pulled " + cached)
+			return logger.Done()
+		}
+	}
+
+	platform, err := containerPlatform(n.Arch)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	err = dock.ImageBuild(n.Image, dockerFile, pullParent, labels, platform)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	if cached != "" {
+		err = dock.ImageTag(n.Image, cached)
+		if err == nil {
+			err = dock.ImagePush(cached)
+		}
+		if err != nil {
+			logger.ExtraInfo(fmt.Sprintf("pushing %s failed: %s", cached, err))
+			logger.Drop()
+		}
+	}
+
+	return logger.Done()
+}
+
+// cachedImageName function returns name of image in registry
+// repository, tagged with hash of Dockerfile and digest of
+// parent image, so images built from the same are shared.
+//
+// Parent image is pulled first if needed, as its digest
+// has to be known.
+func cachedImageName(dock docker.Engine, cache, parent string, pullParent bool, dockerFile []byte) (string, error) {
+	if pullParent {
+		err := dock.ImagePull(parent)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	digest, err := dock.ImageDigest(parent)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(dockerFile)
+	hash.Write([]byte(digest))
+
+	return fmt.Sprintf("%s:%x", cache, hash.Sum(nil)), nil
+}
+
+// pullCachedImage function pulls image from registry and tags
+// it with given name, if it's there and isn't older than given age.
+//
+// Image missing in registry, or unreachable registry,
+// is not an error, image is built then.
+func pullCachedImage(dock docker.Engine, logger *log.Logger, cached, name string, maxAge time.Duration) (bool, error) {
+	err := dock.ImagePull(cached)
+	if err != nil {
+		logger.ExtraInfo(fmt.Sprintf("%s not pulled: %s", cached, err))
+		logger.Drop()
+		return false, nil
+	}
+
+	created, err := dock.ImageCreated(cached)
+	if err != nil {
+		return false, err
+	}
+	if time.Since(created) >= maxAge {
+		logger.ExtraInfo(cached + " is too old")
+		logger.Drop()
+		return false, nil
+	}
+
+	err = dock.ImageTag(cached, name)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// isDockerfileCurrent function checks if Dockerfile rendered
+// for given parent image still has the given checksum.
+func isDockerfileCurrent(parent, target, hash string, mirrors dockerfile.Mirrors, packages []string) (bool, error) {
+	repo, ok := strings.CutSuffix(parent, ":"+target)
+	if !ok {
+		return false, nil
+	}
+
+	dockerFile, err := dockerfile.Parse(repo, target, mirrors, packages)
+	if err != nil {
+		return false, err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(dockerFile)) == hash, nil
+}
+
+// SaveImages function writes given images to tarball,
+// so they can be loaded elsewhere with LoadImages().
+func SaveImages(dock docker.Engine, names []string, path string) error {
+	log.Info("Saving images")
+
+	if len(names) == 0 {
+		return log.Failed(errors.New("no images to save"))
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return log.Failed(err)
+	}
+
+	err = dock.ImageSave(names, file)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return log.Failed(err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return log.Failed(err)
+	}
+
+	log.Drop()
+	for _, name := range names {
+		log.ExtraInfo(name)
+		log.Drop()
+	}
+
+	return log.Done()
+}
+
+// LoadImages function loads images from tarball and reports
+// the ones that are going to be rebuilt anyway, because they're
+// too old, not labeled by deber, or their Dockerfile has changed.
+func LoadImages(dock docker.Engine, path string, maxAge time.Duration, mirrors dockerfile.Mirrors, packages []string) error {
+	log.Info("Loading images")
+
+	file, err := os.Open(path)
+	if err != nil {
+		return log.Failed(err)
+	}
+	defer file.Close()
+
+	names, err := dock.ImageLoad(file)
+	if err != nil {
+		return log.Failed(err)
+	}
+
+	log.Drop()
+
+	for _, name := range names {
+		age, err := dock.ImageAge(name)
+		if err != nil {
+			return log.Failed(err)
+		}
+
+		labels, err := dock.ImageLabels(name)
+		if err != nil {
+			return log.Failed(err)
+		}
+
+		hash, isLabeled := labels[LabelDockerfileHash]
+		isCurrent, err := isDockerfileCurrent(labels[LabelParent], labels[LabelTarget], hash, mirrors, packages)
+		if err != nil {
+			return log.Failed(err)
+		}
+
+		info := name
+		switch {
+		case !isLabeled:
+			info += ", not built by deber, will be rebuilt"
+		case !isCurrent:
+			info += ", Dockerfile changed, will be rebuilt"
+		case age >= maxAge:
+			info += ", too old, will be rebuilt"
+		}
+
+		log.ExtraInfo(info)
+		log.Drop()
+	}
+
+	return log.Done()
+}
+
+// imagePlatform function returns platform of images pulled
+// for given architecture, or host one if it's empty,
+// as named by DockerHub.
+func imagePlatform(arch string) (string, error) {
+	if arch != "" {
+		return dockerhub.Platform(arch)
+	}
+
+	switch runtime.GOARCH {
+	case "arm":
+		// armhf
+		return "arm/v7", nil
+	default:
+		return runtime.GOARCH, nil
+	}
+}
+
+// debootstrap function bootstraps minimal root filesystem of given suite
+// on host and imports it as image with given name.
+//
+// It requires root privileges and debootstrap installed on host.
+func debootstrap(dock docker.Engine, logger *log.Logger, image, suite string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("debootstrap requires root privileges")
+	}
+
+	rootfs, err := os.MkdirTemp("", "deber-rootfs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rootfs)
+
+	cmd := exec.Command("debootstrap", "--variant=minbase", suite, rootfs)
+	cmd.Stdout = logger.Output
+	cmd.Stderr = logger.Output
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("debootstrap: %w", err)
+	}
+
+	tar := exec.Command("tar", "-C", rootfs, "-c", ".")
+	tar.Stderr = logger.Output
+
+	stdout, err := tar.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = tar.Start()
+	if err != nil {
+		return err
+	}
+
+	err = dock.ImageImport(image, stdout)
+	if err != nil {
+		_ = tar.Process.Kill()
+		_ = tar.Wait()
+		return err
+	}
+
+	return tar.Wait()
+}
@@ -0,0 +1,244 @@
+package steps
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+// CompareArgs struct represents arguments
+// passed to Compare().
+type CompareArgs struct {
+	// Mirror is where official packages are downloaded from
+	Mirror string
+	// DiffoscopeReport is where HTML report of diffoscope is written
+	DiffoscopeReport string
+}
+
+// Compare function downloads official binary packages of the same
+// version from given mirror (like snapshot.debian.org) and runs
+// "debdiff" on them and locally built ones, reporting differences.
+func Compare(dock docker.Engine, n *naming.Naming, compareArgs CompareArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Comparing with archive")
+
+	if compareArgs.Mirror == "" && compareArgs.DiffoscopeReport == "" {
+		return logger.Skipped()
+	}
+
+	logger.Drop()
+
+	if compareArgs.Mirror != "" {
+		err := compareWithMirror(dock, n, compareArgs.Mirror)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	if compareArgs.DiffoscopeReport != "" {
+		err := compareWithPrevious(n, compareArgs.DiffoscopeReport)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	return logger.Done()
+}
+
+// compareWithMirror function runs "debdiff" in container
+// for every built package found in mirror.
+func compareWithMirror(dock docker.Engine, n *naming.Naming, mirror string) error {
+	logger := log.For(n.Container)
+
+	files, err := filepath.Glob(filepath.Join(n.BuildDir, fmt.Sprintf("*_%s_*.deb", n.VersionNoEpoch)))
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(n.BuildDir, referenceDir)
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	differences := 0
+	for _, file := range files {
+		name := filepath.Base(file)
+		logger.ExtraInfo(name)
+
+		found, err := downloadReference(mirror, n.Source, name, filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if !found {
+			_ = logger.Skipped()
+			continue
+		}
+
+		logger.Drop()
+
+		args := docker.ContainerExecArgs{
+			Name: n.Container,
+			Cmd:  fmt.Sprintf("debdiff %s %s", filepath.Join(naming.ContainerBuildDir, referenceDir, name), filepath.Join(naming.ContainerBuildDir, name)),
+		}
+
+		// Exit status 1 means that debdiff found differences
+		err = dock.ContainerExec(args)
+		var execErr *docker.ExecError
+		if errors.As(err, &execErr) && execErr.ExitCode == 1 {
+			differences++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if differences > 0 {
+		logger.ExtraInfo(fmt.Sprintf("%d of %d packages differ", differences, len(files)))
+		logger.Drop()
+	}
+
+	return nil
+}
+
+// compareWithPrevious function runs "diffoscope" on host for every
+// .changes file of current build that was also archived before.
+//
+// If report path is a directory, or there are several .changes files,
+// report is named after .changes file.
+func compareWithPrevious(n *naming.Naming, report string) error {
+	logger := log.For(n.Container)
+
+	_, err := exec.LookPath("diffoscope")
+	if err != nil {
+		return errors.New("diffoscope not found on host, install it first")
+	}
+
+	files, err := filepath.Glob(filepath.Join(n.BuildDir, fmt.Sprintf("*_%s_*.changes", n.VersionNoEpoch)))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		logger.ExtraInfo("diffoscope " + name)
+
+		previous := filepath.Join(n.PackagesVersionDir, name)
+		_, err := os.Stat(previous)
+		if errors.Is(err, os.ErrNotExist) {
+			_ = logger.Skipped()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		path := report
+		info, _ := os.Stat(path)
+		switch {
+		case info != nil && info.IsDir():
+			path = filepath.Join(path, strings.TrimSuffix(name, ".changes")+".html")
+		case len(files) > 1:
+			// Reports of several .changes files would overwrite each other
+			extension := filepath.Ext(path)
+			path = strings.TrimSuffix(path, extension) + "_" + strings.TrimSuffix(name, ".changes") + extension
+		}
+
+		// Exit status 1 means that diffoscope found differences
+		cmd := exec.Command("diffoscope", "--html", path, "--text", "-", previous, file)
+		output, err := cmd.Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			logger.Drop()
+			logger.ExtraInfo("differences found, see " + path)
+			logger.Drop()
+			fmt.Fprint(logger.Output, headLines(string(output), diffoscopeLogLines))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("diffoscope: %w", err)
+		}
+
+		_ = logger.Done()
+	}
+
+	return nil
+}
+
+// headLines function returns first given number of lines of text,
+// noting how many lines were left out.
+func headLines(text string, max int) string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= max {
+		return text
+	}
+
+	return strings.Join(lines[:max], "") + fmt.Sprintf("... %d more lines in report\n", len(lines)-max)
+}
+
+// downloadReference function fetches binary package from mirror's pool,
+// trying every archive area, as it's not known which one has it.
+//
+// False is returned if package isn't there.
+func downloadReference(mirror, source, name, path string) (bool, error) {
+	prefix := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		prefix = source[:4]
+	}
+
+	client := http.Client{Timeout: 5 * time.Minute}
+
+	for _, component := range []string{"main", "contrib", "non-free", "non-free-firmware"} {
+		url := strings.Join([]string{strings.TrimSuffix(mirror, "/"), "pool", component, prefix, source, name}, "/")
+
+		response, err := client.Get(url)
+		if err != nil {
+			return false, err
+		}
+
+		if response.StatusCode == http.StatusNotFound {
+			response.Body.Close()
+			continue
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return false, fmt.Errorf("%s: %s", url, response.Status)
+		}
+
+		file, err := os.Create(path)
+		if err != nil {
+			response.Body.Close()
+			return false, err
+		}
+
+		_, err = io.Copy(file, response.Body)
+		response.Body.Close()
+		if err != nil {
+			file.Close()
+			return false, err
+		}
+
+		return true, file.Close()
+	}
+
+	return false, nil
+}
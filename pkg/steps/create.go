@@ -0,0 +1,590 @@
+package steps
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	units "github.com/docker/go-units"
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+	"github.com/dpvpro/deber/pkg/util"
+)
+
+// parseLimits function parses memory limit in human units,
+// like "2g", and CPU limit, like "1.5", up to given number of CPUs,
+// returning them in bytes and billionths of CPU. Empty ones are zero,
+// meaning no limit.
+func parseLimits(memory, cpus string, maxCPUs int) (int64, int64, error) {
+	var bytes, nanoCPUs int64
+
+	if memory != "" {
+		var err error
+		bytes, err = units.RAMInBytes(memory)
+		if err != nil || bytes <= 0 {
+			return 0, 0, fmt.Errorf("invalid memory limit: %s", memory)
+		}
+	}
+
+	if cpus != "" {
+		value, err := strconv.ParseFloat(cpus, 64)
+		if err != nil || value <= 0 || value > float64(maxCPUs) {
+			return 0, 0, fmt.Errorf("invalid CPU limit: %s, container engine has %d CPUs", cpus, maxCPUs)
+		}
+		nanoCPUs = int64(value * 1e9)
+	}
+
+	return bytes, nanoCPUs, nil
+}
+
+// containerPlatform function returns platform images are built
+// and containers created for, given architecture other than host
+// one, or empty string, meaning default one, otherwise.
+func containerPlatform(arch string) (string, error) {
+	if arch == "" {
+		return "", nil
+	}
+
+	platform, err := imagePlatform(arch)
+	if err != nil {
+		return "", err
+	}
+
+	return "linux/" + platform, nil
+}
+
+// CreateArgs struct represents arguments
+// passed to Create().
+type CreateArgs struct {
+	// ExtraPackages are additional packages mounted in archive directory
+	ExtraPackages []string
+	// SourcesList is custom apt sources list mounted in container
+	SourcesList string
+	// Snapshot is timestamp of snapshot.debian.org archive Depends()
+	// replaces apt sources with, so container without it is recreated
+	Snapshot string
+	// KeepVolumes prevents removal of anonymous volumes
+	// when container is recreated
+	KeepVolumes bool
+	// GpgAgent enables mounting of host's GPG agent
+	GpgAgent bool
+	// Hostname of container
+	Hostname string
+	// DNS servers used by container
+	DNS []string
+	// ExtraHosts are static host mappings, as "name:ip"
+	ExtraHosts []string
+	// ReadOnlySource mounts source directory read-only,
+	// with writable copy of debian directory over it
+	ReadOnlySource bool
+	// TmpDir is temporary directory of build in container
+	TmpDir string
+	// TmpDirFrom is what backs temporary directory,
+	// either TmpDirTmpfs or host directory, or nothing
+	TmpDirFrom string
+	// Labels are additional labels of container
+	Labels map[string]string
+	// Init runs init as PID 1 in container
+	Init bool
+	// CopySource mounts source directory read-only elsewhere,
+	// to be copied to build directory by CopySource()
+	CopySource bool
+	// LanguageCaches are names of language caches to mount
+	LanguageCaches []string
+	// LanguageCachesDir is host directory holding language caches
+	LanguageCachesDir string
+	// Runtime is container runtime (like runsc or kata),
+	// Docker Engine's default if empty
+	Runtime string
+	// Rootless runs build as root of container, which rootless
+	// Docker Engine maps to user running it
+	Rootless bool
+	// Memory limits memory of container, like "2g", no limit if empty
+	Memory string
+	// CPUs limits number of CPUs container uses, like "1.5",
+	// no limit if empty
+	CPUs string
+}
+
+// Create function commands Docker Engine to create container.
+//
+// If extra packages are provided, it checks if they are correct
+// and mounts them.
+//
+// If container already exists and mounts or settings are different,
+// then it removes the old one and creates new with proper ones.
+//
+// Also makes directories on host and moves tarball if needed.
+func Create(dock docker.Engine, n *naming.Naming, createArgs CreateArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Creating container")
+
+	mounts := []mount.Mount{
+		{
+			Type:   mount.TypeBind,
+			Source: n.SourceDir,
+			Target: naming.ContainerSourceDir,
+		}, {
+			Type:   mount.TypeBind,
+			Source: n.BuildDir,
+			Target: naming.ContainerBuildDir,
+		}, {
+			Type:   mount.TypeBind,
+			Source: n.CacheDir,
+			Target: naming.ContainerCacheDir,
+		},
+	}
+
+	// Handle read-only source mounting
+	if createArgs.ReadOnlySource {
+		mounts[0].ReadOnly = true
+
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   filepath.Join(n.SourceDir, "debian"),
+			Target:   naming.ContainerSourceDebianDir,
+			ReadOnly: true,
+		}, mount.Mount{
+			Type:   mount.TypeTmpfs,
+			Target: filepath.Join(naming.ContainerSourceDir, "debian"),
+		})
+	}
+
+	// Handle copied source mounting
+	if createArgs.CopySource {
+		mounts[0].Target = naming.ContainerSourceCopyDir
+		mounts[0].ReadOnly = true
+	}
+
+	// Handle language caches mounting
+	for _, name := range createArgs.LanguageCaches {
+		if _, ok := LanguageCaches[name]; !ok {
+			return logger.Failed(fmt.Errorf("unknown language cache: %s", name))
+		}
+
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: filepath.Join(createArgs.LanguageCachesDir, name),
+			Target: filepath.Join(naming.ContainerLanguageCacheDir, name),
+		})
+	}
+
+	// Handle temporary directory mounting
+	if createArgs.TmpDir != "" && createArgs.TmpDirFrom != "" {
+		mnt, err := tmpDirMount(createArgs.TmpDir, createArgs.TmpDirFrom)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		mounts = append(mounts, mnt)
+	}
+
+	// Handle extra packages mounting
+	for _, pkg := range createArgs.ExtraPackages {
+		// /path/to/directory/with/packages/*
+		files, err := filepath.Glob(pkg)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		for _, file := range files {
+			source, err := filepath.Abs(file)
+			if err != nil {
+				return logger.Failed(err)
+			}
+
+			info, err := os.Stat(source)
+			if info == nil {
+				return logger.Failed(err)
+			}
+			if !info.IsDir() && !strings.HasSuffix(source, ".deb") {
+				return logger.Failed(errors.New("please specify a directory or .deb file"))
+			}
+
+			target := filepath.Join(naming.ContainerArchiveDir, filepath.Base(source))
+
+			mnt := mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   source,
+				Target:   target,
+				ReadOnly: true,
+			}
+
+			mounts = append(mounts, mnt)
+		}
+	}
+
+	// Handle custom sources list mounting
+	if createArgs.SourcesList != "" {
+		source, err := filepath.Abs(createArgs.SourcesList)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		err = validateSourcesList(source)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		mnt := mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   source,
+			Target:   naming.ContainerSourcesListFile,
+			ReadOnly: true,
+		}
+
+		mounts = append(mounts, mnt)
+	}
+
+	// Handle GPG agent mounting
+	if createArgs.GpgAgent {
+		gpgMounts, err := gpgAgentMounts()
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		mounts = append(mounts, gpgMounts...)
+	}
+
+	err := validateHostSettings(createArgs)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	if createArgs.Runtime != "" {
+		runtimes, err := dock.Runtimes()
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		if !slices.Contains(runtimes, createArgs.Runtime) {
+			return logger.Failed(fmt.Errorf("runtime %s is not available, Docker Engine has: %s", createArgs.Runtime, strings.Join(runtimes, ", ")))
+		}
+	}
+
+	user := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	userns, err := dock.UserNamespace()
+	if err != nil {
+		return logger.Failed(err)
+	}
+	usernsMode := ""
+	switch {
+	case createArgs.Rootless && userns == docker.UserNamespaceRootless:
+		user = "0:0"
+	case createArgs.Rootless && userns == docker.UserNamespaceRemap:
+		return logger.Failed(errors.New("users are remapped to subordinate IDs by container engine, files written by build wouldn't belong to you, use rootless one instead"))
+	case createArgs.Rootless:
+		return logger.Failed(errors.New("rootless container engine is required, otherwise root of container is root on host"))
+	default:
+		usernsMode = dock.UsernsMode(userns)
+	}
+	platform, err := containerPlatform(n.Arch)
+	if err != nil {
+		return logger.Failed(err)
+	}
+	// Engine may run on other machine than deber
+	maxCPUs := 0
+	if createArgs.CPUs != "" {
+		maxCPUs, err = dock.CPUs()
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+	memory, nanoCPUs, err := parseLimits(createArgs.Memory, createArgs.CPUs, maxCPUs)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	args := docker.ContainerCreateArgs{
+		Mounts:     mounts,
+		Image:      n.Image,
+		Name:       n.Container,
+		User:       user,
+		Hostname:   createArgs.Hostname,
+		DNS:        createArgs.DNS,
+		ExtraHosts: createArgs.ExtraHosts,
+		Init:       createArgs.Init,
+		Runtime:    createArgs.Runtime,
+		UsernsMode: usernsMode,
+		Platform:   platform,
+		Memory:     memory,
+		NanoCPUs:   nanoCPUs,
+		Labels: map[string]string{
+			LabelSource: n.Source,
+			LabelTarget: n.Target,
+		},
+	}
+	for key, value := range createArgs.Labels {
+		args.Labels[key] = value
+	}
+	if createArgs.Snapshot != "" {
+		args.Labels[LabelSnapshot] = createArgs.Snapshot
+	}
+
+	// Mounts are compared separately, as they can be inspected
+	settings := args
+	settings.Mounts = nil
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%+v", settings))))
+	args.Labels[LabelSettingsHash] = checksum
+
+	isContainerCreated, err := dock.IsContainerCreated(n.Container)
+	if err != nil {
+		return logger.Failed(err)
+	}
+	if isContainerCreated {
+		oldMounts, err := dock.ContainerMounts(n.Container)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		oldLabels, err := dock.ContainerLabels(n.Container)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		// Compare old mounts and settings with new ones,
+		// if not equal, then recreate container
+		if util.CompareMounts(oldMounts, mounts) && oldLabels[LabelSettingsHash] == checksum {
+			return logger.Skipped()
+		}
+
+		err = dock.ContainerStop(n.Container)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		err = dock.ContainerRemove(n.Container, !createArgs.KeepVolumes)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	// Make directories if non existent
+	for _, mnt := range mounts {
+		if mnt.Type != mount.TypeBind {
+			continue
+		}
+
+		info, _ := os.Stat(mnt.Source)
+		if info != nil {
+			continue
+		}
+
+		err := os.MkdirAll(mnt.Source, os.ModePerm)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	err = dock.ContainerCreate(args)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	return logger.Done()
+}
+
+// tmpDirMount function returns mount backing temporary directory.
+func tmpDirMount(dir, from string) (mount.Mount, error) {
+	err := validateTmpDir(dir)
+	if err != nil {
+		return mount.Mount{}, err
+	}
+
+	if from == TmpDirTmpfs {
+		mnt := mount.Mount{
+			Type:   mount.TypeTmpfs,
+			Target: dir,
+		}
+		return mnt, nil
+	}
+
+	source, err := filepath.Abs(from)
+	if err != nil {
+		return mount.Mount{}, err
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return mount.Mount{}, err
+	}
+	if !info.IsDir() {
+		return mount.Mount{}, fmt.Errorf("%s is not a directory", source)
+	}
+
+	mnt := mount.Mount{
+		Type:   mount.TypeBind,
+		Source: source,
+		Target: dir,
+	}
+
+	return mnt, nil
+}
+
+// validateTmpDir function checks if temporary directory
+// is a sane absolute path in container.
+func validateTmpDir(dir string) error {
+	if !filepath.IsAbs(dir) || filepath.Clean(dir) != dir || dir == "/" {
+		return fmt.Errorf("invalid temporary directory: %s", dir)
+	}
+
+	return nil
+}
+
+// CopyDebian function copies debian directory of read-only source
+// to writable filesystem mounted over it, replacing what was there.
+func CopyDebian(dock docker.Engine, n *naming.Naming) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Copying debian directory")
+
+	args := docker.ContainerExecArgs{
+		Name:    n.Container,
+		Cmd:     "find debian -mindepth 1 -delete && cp -a " + naming.ContainerSourceDebianDir + "/. debian/",
+		WorkDir: naming.ContainerSourceDir,
+	}
+	err := dock.ContainerExec(args)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	return logger.Done()
+}
+
+// CopySource function copies read-only source to build directory,
+// replacing previous copy, without files matching ignore patterns.
+func CopySource(dock docker.Engine, n *naming.Naming, ignore []string) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Copying source")
+
+	excludes := ""
+	for _, pattern := range ignore {
+		excludes += " --exclude='./" + strings.ReplaceAll(pattern, "'", `'\''`) + "'"
+	}
+
+	args := docker.ContainerExecArgs{
+		Name: n.Container,
+		Cmd: strings.Join([]string{
+			"rm -rf " + naming.ContainerSourceDir,
+			"mkdir " + naming.ContainerSourceDir,
+			"tar -C " + naming.ContainerSourceCopyDir + excludes + " -cf - . | tar -C " + naming.ContainerSourceDir + " -xf -",
+		}, " && "),
+		WorkDir: naming.ContainerBuildDir,
+	}
+	err := dock.ContainerExec(args)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	return logger.Done()
+}
+
+// validateHostSettings function checks if hostname
+// and DNS servers are valid.
+func validateHostSettings(createArgs CreateArgs) error {
+	if createArgs.Hostname != "" && !hostnameRegexp.MatchString(createArgs.Hostname) {
+		return fmt.Errorf("invalid hostname: %s", createArgs.Hostname)
+	}
+
+	for _, dns := range createArgs.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid DNS server address: %s", dns)
+		}
+	}
+
+	for _, host := range createArgs.ExtraHosts {
+		name, ip, ok := strings.Cut(host, ":")
+		if !ok || !hostnameRegexp.MatchString(name) || net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid host mapping, expected name:ip: %s", host)
+		}
+	}
+
+	return nil
+}
+
+// gpgAgentMounts function discovers host's GnuPG home directory
+// and GPG agent socket and returns mounts for them.
+//
+// Extra socket of agent is used, as it's meant for
+// restricted access from remote, less trusted places.
+func gpgAgentMounts() ([]mount.Mount, error) {
+	homeDir, err := gpgconfDir("homedir")
+	if err != nil {
+		return nil, err
+	}
+
+	socket, err := gpgconfDir("agent-extra-socket")
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		return nil, fmt.Errorf("gpg agent socket not found, is gpg-agent running? %w", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s is not a socket", socket)
+	}
+
+	mounts := []mount.Mount{
+		{
+			Type:     mount.TypeBind,
+			Source:   homeDir,
+			Target:   naming.ContainerGnupgDir,
+			ReadOnly: true,
+		}, {
+			Type:   mount.TypeBind,
+			Source: socket,
+			Target: naming.ContainerGpgAgentSocket,
+		},
+	}
+
+	return mounts, nil
+}
+
+// validateSourcesList function checks if given file is a one-line-style
+// apt sources list with at least one entry.
+func validateSourcesList(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("sources list is not a regular file")
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	entries := 0
+	for _, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "deb ") && !strings.HasPrefix(line, "deb-src ") {
+			return fmt.Errorf("invalid sources list entry: %s", line)
+		}
+
+		entries++
+	}
+
+	if entries == 0 {
+		return errors.New("sources list has no entries")
+	}
+
+	return nil
+}
@@ -0,0 +1,661 @@
+package steps
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/dpvpro/deber/pkg/control"
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+var (
+	// apt and aptitude summaries of packages to install
+	aptPackagesRegexp  = regexp.MustCompile(`(\d+) (?:packages )?upgraded, (\d+) newly installed`)
+	aptDownloadRegexp  = regexp.MustCompile(`Need to get ([\d.]+ ?[kMGT]?B)\b`)
+	aptDiskSpaceRegexp = regexp.MustCompile(`(?:After this operation,|After unpacking) ([\d.]+ ?[kMGT]?B) .*?(used|freed)`)
+
+	// apt error about package it couldn't download
+	aptFetchRegexp = regexp.MustCompile(`Failed to fetch \S*/([a-z0-9][a-z0-9+.-]+)_[^/\s]*\.deb`)
+)
+
+// DependsArgs struct represents arguments
+// passed to Depends().
+type DependsArgs struct {
+	// ExtraPackages are additional packages mounted in archive directory
+	ExtraPackages []string
+	// InstallRecommends enables installation of recommended packages
+	InstallRecommends bool
+	// SourcesList is custom apt sources list mounted in container
+	SourcesList string
+	// RecordFile is where installed package versions are recorded
+	RecordFile string
+	// ReplayFile is where package versions to pin are read from
+	ReplayFile string
+	// FreshLists forces apt to download package lists from scratch
+	FreshLists bool
+	// AptPin is apt preferences file copied to container
+	AptPin string
+	// PreferLocal pins packages from local archive above all others
+	PreferLocal bool
+	// SeedFile lists packages downloaded to cache in advance
+	SeedFile string
+	// Profiles are space separated build profiles
+	Profiles string
+	// Upgrade upgrades installed packages before installing dependencies
+	Upgrade bool
+	// Snapshot is timestamp of snapshot.debian.org archive
+	// used instead of default apt sources
+	Snapshot string
+	// MaxParallelDownloads tunes apt downloads, 1 serializes them,
+	// more allows that many requests in flight per host, 0 is default
+	MaxParallelDownloads int
+	// Resolver solves build dependencies, one of Resolver* constants,
+	// ResolverApt if empty
+	Resolver string
+	// Lock writes lockfile of installed package versions
+	// to build directory, so it's archived along with packages
+	Lock bool
+	// Downloads, if set, is filled with numbers and sizes
+	// of packages installed
+	Downloads *Downloads
+	// NoNetwork installs dependencies from apt cache only,
+	// without network access
+	NoNetwork bool
+}
+
+// Downloads struct represents packages downloaded and installed
+// by Depends(), as reported by apt.
+type Downloads struct {
+	// Installed is number of newly installed packages
+	Installed int `json:"installed"`
+	// Upgraded is number of upgraded packages
+	Upgraded int `json:"upgraded"`
+	// Size is number of bytes downloaded
+	Size int64 `json:"size"`
+	// DiskSpace is number of bytes of disk space used,
+	// negative if freed
+	DiskSpace int64 `json:"diskSpace"`
+}
+
+// String function returns human readable report of downloads.
+func (downloads Downloads) String() string {
+	if downloads.Installed == 0 && downloads.Upgraded == 0 {
+		return "nothing to install"
+	}
+
+	diskSpace, verb := downloads.DiskSpace, "used"
+	if diskSpace < 0 {
+		diskSpace, verb = -diskSpace, "freed"
+	}
+
+	return fmt.Sprintf(
+		"%d installed, %d upgraded, %s downloaded, %s of disk space %s",
+		downloads.Installed, downloads.Upgraded,
+		units.HumanSize(float64(downloads.Size)), units.HumanSize(float64(diskSpace)), verb,
+	)
+}
+
+// Depends function installs build dependencies of package
+// in container.
+func Depends(dock docker.Engine, n *naming.Naming, depsArgs DependsArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Installing dependencies")
+
+	// Unparsable control file simply disables skipping,
+	// extra packages may change without changing their paths
+	checksum, _ := dependsChecksum(n, depsArgs)
+	lockFile := filepath.Join(n.BuildDir, lockFileName(n))
+	_, errLock := os.Stat(lockFile)
+	isLocked := !depsArgs.Lock || errLock == nil
+	if checksum != "" && isLocked && !depsArgs.FreshLists && !depsArgs.Upgrade && depsArgs.ExtraPackages == nil {
+		buffer := new(bytes.Buffer)
+		args := docker.ContainerExecArgs{
+			Name:   n.Container,
+			Cmd:    "cat " + dependsChecksumFile + " 2>/dev/null || true",
+			Output: buffer,
+		}
+		err := dock.ContainerExec(args)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		if strings.TrimSpace(buffer.String()) == checksum {
+			return logger.Skipped()
+		}
+	}
+
+	if depsArgs.MaxParallelDownloads < 0 {
+		return logger.Failed(fmt.Errorf("invalid maximum of parallel downloads: %d", depsArgs.MaxParallelDownloads))
+	}
+
+	if depsArgs.Snapshot != "" {
+		_, err := time.Parse(SnapshotFormat, depsArgs.Snapshot)
+		if err != nil {
+			return logger.Failed(fmt.Errorf("invalid snapshot timestamp, expected like 20240101T000000Z: %s", depsArgs.Snapshot))
+		}
+
+		// snapshot.debian.org serves Debian archive only
+		labels, err := dock.ImageLabels(n.Image)
+		if err != nil {
+			return logger.Failed(err)
+		}
+		repo, _, _ := strings.Cut(labels[LabelParent], ":")
+		if path.Base(repo) == "ubuntu" {
+			return logger.Failed(fmt.Errorf("snapshot can't be used for Ubuntu target %s", n.Target))
+		}
+	}
+
+	if depsArgs.NoNetwork {
+		err := checkNoNetwork(depsArgs)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	seeds := make([]string, 0)
+	if depsArgs.SeedFile != "" {
+		var err error
+		seeds, err = readSeeds(depsArgs.SeedFile)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	logger.Drop()
+
+	buildDep, resolverPackages, err := buildDepCommand(depsArgs)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	upgrade := "apt-get dist-upgrade"
+	if !depsArgs.InstallRecommends {
+		upgrade += " --no-install-recommends"
+	}
+
+	args := []docker.ContainerExecArgs{
+		{
+			Name:    n.Container,
+			Cmd:     "rm -f a.sources",
+			AsRoot:  true,
+			WorkDir: "/etc/apt/sources.list.d",
+		}, {
+			Name:    n.Container,
+			Cmd:     "rm -f ./*",
+			AsRoot:  true,
+			WorkDir: "/etc/apt/sources.list.d",
+			Skip:    depsArgs.SourcesList == "" && depsArgs.Snapshot == "",
+		}, {
+			Name:   n.Container,
+			Cmd:    ": > /etc/apt/sources.list",
+			AsRoot: true,
+			Skip:   depsArgs.Snapshot == "",
+		}, {
+			Name:    n.Container,
+			Cmd:     "echo URIs: file://" + naming.ContainerArchiveDir + " ./ > a.sources",
+			AsRoot:  true,
+			WorkDir: "/etc/apt/sources.list.d",
+			Skip:    depsArgs.ExtraPackages == nil,
+		}, {
+			Name:    n.Container,
+			Cmd:     "dpkg-scanpackages -m . > Packages",
+			AsRoot:  true,
+			WorkDir: naming.ContainerArchiveDir,
+			Skip:    depsArgs.ExtraPackages == nil,
+		}, {
+			Name:    n.Container,
+			Cmd:     "rm -f " + replayPreferencesFile + " " + pinPreferencesFile + " " + localPreferencesFile,
+			AsRoot:  true,
+			WorkDir: aptPreferencesDir,
+		}, {
+			Name:    n.Container,
+			Cmd:     "rm -f " + downloadsConfigFile,
+			AsRoot:  true,
+			WorkDir: aptConfigDir,
+		},
+	}
+
+	err = execSequence(dock, args)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	if depsArgs.MaxParallelDownloads > 0 {
+		config := aptDownloadsConfig(depsArgs.MaxParallelDownloads)
+
+		err = dock.ContainerCopyFile(n.Container, aptConfigDir, downloadsConfigFile, config, 0644)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	if depsArgs.Snapshot != "" {
+		sources := fmt.Sprintf(
+			"Types: deb\nURIs: %s/%s/\nSuites: %s\nComponents: main\nCheck-Valid-Until: no\n",
+			snapshotURL, depsArgs.Snapshot, n.Target,
+		)
+
+		err = dock.ContainerCopyFile(n.Container, "/etc/apt/sources.list.d", snapshotSourcesFile, []byte(sources), 0644)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	if depsArgs.ReplayFile != "" {
+		preferences, err := replayPreferences(depsArgs.ReplayFile)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		err = dock.ContainerCopyFile(n.Container, aptPreferencesDir, replayPreferencesFile, preferences, 0644)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	if depsArgs.PreferLocal {
+		preferences := []byte("Package: *\nPin: origin \"\"\nPin-Priority: 1001\n")
+
+		err = dock.ContainerCopyFile(n.Container, aptPreferencesDir, localPreferencesFile, preferences, 0644)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	if depsArgs.AptPin != "" {
+		preferences, err := readPreferences(depsArgs.AptPin)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		err = dock.ContainerCopyFile(n.Container, aptPreferencesDir, pinPreferencesFile, preferences, 0644)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	args = []docker.ContainerExecArgs{
+		{
+			Name:   n.Container,
+			Cmd:    "rm -rf /var/lib/apt/lists/* " + naming.ContainerCacheDir + "/*.bin",
+			AsRoot: true,
+			Skip:   !depsArgs.FreshLists,
+		}, {
+			Name:    n.Container,
+			Cmd:     "apt-get update",
+			AsRoot:  true,
+			Network: true,
+			Skip:    depsArgs.NoNetwork,
+		}, {
+			// Only local archive can be updated without network,
+			// lists of remote ones are kept as they are
+			Name:   n.Container,
+			Cmd:    "apt-get update -o Acquire::Retries=0 || true",
+			AsRoot: true,
+			Skip:   !depsArgs.NoNetwork || depsArgs.ExtraPackages == nil,
+		}, {
+			Name:    n.Container,
+			Cmd:     "apt-get install --download-only --no-install-recommends " + strings.Join(seeds, " "),
+			Network: true,
+			AsRoot:  true,
+			Skip:    len(seeds) == 0,
+		}, {
+			Name:    n.Container,
+			Cmd:     upgrade,
+			Network: true,
+			AsRoot:  true,
+			Skip:    !depsArgs.Upgrade,
+		}, {
+			Name:    n.Container,
+			Cmd:     "apt-get install --no-install-recommends " + resolverPackages,
+			Network: !depsArgs.NoNetwork,
+			AsRoot:  true,
+			Skip:    resolverPackages == "",
+		},
+	}
+
+	err = execSequence(dock, args)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	buffer := new(bytes.Buffer)
+	arg := docker.ContainerExecArgs{
+		Name:    n.Container,
+		Cmd:     buildDep,
+		Network: !depsArgs.NoNetwork,
+		AsRoot:  true,
+		Output:  io.MultiWriter(logger.Output, buffer),
+	}
+	err = dock.ContainerExec(arg)
+	if err != nil && depsArgs.NoNetwork {
+		missing := missingPackages(buffer.String())
+		if len(missing) > 0 {
+			return logger.Failed(fmt.Errorf("packages missing from cache: %s", strings.Join(missing, ", ")))
+		}
+	}
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	downloads := parseDownloads(buffer.String())
+	if depsArgs.Downloads != nil {
+		*depsArgs.Downloads = downloads
+	}
+
+	if depsArgs.RecordFile != "" || depsArgs.Lock {
+		buffer := new(bytes.Buffer)
+		args := docker.ContainerExecArgs{
+			Name:   n.Container,
+			Cmd:    "dpkg-query -W -f='${binary:Package}=${Version}\\n'",
+			Output: buffer,
+		}
+		err = dock.ContainerExec(args)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		if depsArgs.RecordFile != "" {
+			err = os.WriteFile(depsArgs.RecordFile, buffer.Bytes(), 0644)
+			if err != nil {
+				return logger.Failed(err)
+			}
+		}
+
+		if depsArgs.Lock {
+			err = os.WriteFile(lockFile, buffer.Bytes(), 0644)
+			if err != nil {
+				return logger.Failed(err)
+			}
+		}
+	}
+
+	if checksum != "" {
+		dir, file := filepath.Split(dependsChecksumFile)
+		err = dock.ContainerCopyFile(n.Container, dir, file, []byte(checksum), 0644)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	logger.ExtraInfo(downloads.String())
+
+	return logger.Done()
+}
+
+// parseDownloads function reads numbers of packages and sizes
+// from summary apt prints before installing them.
+//
+// Aptitude prints the same numbers in slightly different words.
+// Lines that are missing, or unparsable, leave zeros in place.
+func parseDownloads(output string) Downloads {
+	downloads := Downloads{}
+
+	match := aptPackagesRegexp.FindStringSubmatch(output)
+	if match != nil {
+		downloads.Upgraded, _ = strconv.Atoi(match[1])
+		downloads.Installed, _ = strconv.Atoi(match[2])
+	}
+
+	match = aptDownloadRegexp.FindStringSubmatch(output)
+	if match != nil {
+		downloads.Size, _ = units.FromHumanSize(match[1])
+	}
+
+	match = aptDiskSpaceRegexp.FindStringSubmatch(output)
+	if match != nil {
+		downloads.DiskSpace, _ = units.FromHumanSize(match[1])
+		if match[2] == "freed" {
+			downloads.DiskSpace = -downloads.DiskSpace
+		}
+	}
+
+	return downloads
+}
+
+// buildDepCommand function returns command installing build
+// dependencies with chosen resolver, along with packages
+// the resolver needs, if any.
+//
+// Aptitude installs dummy package depending on build
+// dependencies, made by mk-build-deps outside of source.
+func buildDepCommand(depsArgs DependsArgs) (string, string, error) {
+	switch depsArgs.Resolver {
+	case "", ResolverApt, ResolverAptCudf:
+		cmd := "apt-get build-dep"
+		if depsArgs.NoNetwork {
+			cmd += " -o Acquire::Retries=0"
+		}
+		packages := ""
+		if depsArgs.Resolver == ResolverAptCudf {
+			cmd += " --solver aspcud"
+			packages = "apt-cudf aspcud"
+		}
+		if !depsArgs.InstallRecommends {
+			cmd += " --no-install-recommends"
+		}
+		if depsArgs.Profiles != "" {
+			cmd += " -P " + strings.ReplaceAll(depsArgs.Profiles, " ", ",")
+		}
+
+		return cmd + " ./", packages, nil
+	case ResolverAptitude:
+		tool := "aptitude -y"
+		if depsArgs.NoNetwork {
+			tool += " -o Acquire::Retries=0"
+		}
+		if !depsArgs.InstallRecommends {
+			tool += " --without-recommends"
+		}
+
+		cmd := fmt.Sprintf("cd /tmp && mk-build-deps --install --remove --tool '%s'", tool)
+		if depsArgs.Profiles != "" {
+			cmd += " --build-profiles " + strings.ReplaceAll(depsArgs.Profiles, " ", ",")
+		}
+
+		return cmd + " " + filepath.Join(naming.ContainerSourceDir, "debian/control"), "aptitude equivs", nil
+	default:
+		return "", "", fmt.Errorf("unknown resolver: %s", depsArgs.Resolver)
+	}
+}
+
+// checkNoNetwork function checks if dependencies
+// can be installed with given options without network.
+func checkNoNetwork(depsArgs DependsArgs) error {
+	switch {
+	case depsArgs.FreshLists:
+		return errors.New("fresh package lists can't be downloaded without network")
+	case depsArgs.Upgrade:
+		return errors.New("packages can't be upgraded without network")
+	case depsArgs.Snapshot != "":
+		return errors.New("snapshot can't be used without network")
+	case depsArgs.SeedFile != "":
+		return errors.New("seed packages can't be downloaded without network")
+	}
+
+	return nil
+}
+
+// missingPackages function returns names of packages
+// apt failed to download, as reported in its output.
+func missingPackages(output string) []string {
+	missing := make([]string, 0)
+	for _, match := range aptFetchRegexp.FindAllStringSubmatch(output, -1) {
+		if !slices.Contains(missing, match[1]) {
+			missing = append(missing, match[1])
+		}
+	}
+
+	return missing
+}
+
+// aptDownloadsConfig function returns apt configuration
+// allowing given number of parallel downloads.
+//
+// Single download means one queue per access method without
+// pipelining, otherwise there is queue per host with that
+// many requests pipelined.
+func aptDownloadsConfig(max int) []byte {
+	if max == 1 {
+		return []byte("Acquire::Queue-Mode \"access\";\nAcquire::http::Pipeline-Depth \"0\";\n")
+	}
+
+	return []byte(fmt.Sprintf("Acquire::Queue-Mode \"host\";\nAcquire::http::Pipeline-Depth \"%d\";\n", max))
+}
+
+// dependsChecksum function returns SHA-256 checksum of
+// build dependencies fields of debian/control, options
+// the dependencies are installed with and files they use.
+func dependsChecksum(n *naming.Naming, depsArgs DependsArgs) (string, error) {
+	paragraphs, err := control.ParseFile(filepath.Join(n.SourceDir, "debian/control"))
+	if err != nil {
+		return "", err
+	}
+	if len(paragraphs) == 0 {
+		return "", errors.New("debian/control is empty")
+	}
+
+	hash := sha256.New()
+	for _, field := range []string{"Build-Depends", "Build-Depends-Arch", "Build-Depends-Indep"} {
+		fmt.Fprintf(hash, "%s: %s\n", field, paragraphs[0][field])
+	}
+	// Every option affecting installed packages is listed, Downloads
+	// only receives report and NoNetwork installs the same packages
+	fmt.Fprintf(hash, "ExtraPackages: %q\n", depsArgs.ExtraPackages)
+	fmt.Fprintf(hash, "InstallRecommends: %t\n", depsArgs.InstallRecommends)
+	fmt.Fprintf(hash, "RecordFile: %s\n", depsArgs.RecordFile)
+	fmt.Fprintf(hash, "FreshLists: %t\n", depsArgs.FreshLists)
+	fmt.Fprintf(hash, "PreferLocal: %t\n", depsArgs.PreferLocal)
+	fmt.Fprintf(hash, "Profiles: %s\n", depsArgs.Profiles)
+	fmt.Fprintf(hash, "Upgrade: %t\n", depsArgs.Upgrade)
+	fmt.Fprintf(hash, "Snapshot: %s\n", depsArgs.Snapshot)
+	fmt.Fprintf(hash, "MaxParallelDownloads: %d\n", depsArgs.MaxParallelDownloads)
+	fmt.Fprintf(hash, "Resolver: %s\n", depsArgs.Resolver)
+	fmt.Fprintf(hash, "Lock: %t\n", depsArgs.Lock)
+
+	// Files are hashed by contents, as they may change in place
+	files := []struct {
+		name string
+		path string
+	}{
+		{"SourcesList", depsArgs.SourcesList},
+		{"ReplayFile", depsArgs.ReplayFile},
+		{"AptPin", depsArgs.AptPin},
+		{"SeedFile", depsArgs.SeedFile},
+	}
+	for _, file := range files {
+		fmt.Fprintf(hash, "%s: %s\n", file.name, file.path)
+		if file.path == "" {
+			continue
+		}
+
+		contents, err := os.ReadFile(file.path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%d\n", len(contents))
+		hash.Write(contents)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// readSeeds function reads file with package names,
+// one per line, ignoring empty ones and comments.
+func readSeeds(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seeds := make([]string, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !packageNameRegexp.MatchString(line) {
+			return nil, fmt.Errorf("%s: invalid package name: %s", path, line)
+		}
+
+		seeds = append(seeds, line)
+	}
+
+	return seeds, nil
+}
+
+// readPreferences function reads apt preferences file
+// and checks if every entry has all required fields.
+func readPreferences(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	paragraphs, err := control.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(paragraphs) == 0 {
+		return nil, fmt.Errorf("%s: no preferences defined", path)
+	}
+
+	for _, paragraph := range paragraphs {
+		for _, field := range []string{"Package", "Pin", "Pin-Priority"} {
+			if paragraph[field] == "" {
+				return nil, fmt.Errorf("%s: entry without %s field", path, field)
+			}
+		}
+	}
+
+	return content, nil
+}
+
+// lockFileName function returns name of lockfile
+// of installed package versions.
+func lockFileName(n *naming.Naming) string {
+	return fmt.Sprintf("%s_%s.deps.lock", n.Source, n.VersionNoEpoch)
+}
+
+// replayPreferences function reads file with package=version lines
+// and returns apt preferences pinning those exact versions.
+func replayPreferences(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := new(bytes.Buffer)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		pkg, version, ok := strings.Cut(line, "=")
+		if !ok || pkg == "" || version == "" {
+			return nil, fmt.Errorf("invalid dependency record: %s", line)
+		}
+
+		fmt.Fprintf(buffer, "Package: %s\nPin: version %s\nPin-Priority: 1001\n\n", pkg, version)
+	}
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,8 @@
+package steps
+
+// Unexported functions tested in steps_test package
+var (
+	DependsChecksum = dependsChecksum
+	WithSigning     = withSigning
+	HeadLines       = headLines
+)
@@ -0,0 +1,173 @@
+package steps
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/lintian"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+// LintArgs struct represents arguments
+// passed to Lint().
+type LintArgs struct {
+	// Enabled enables the step
+	Enabled bool
+	// LintianFlags are passed to lintian as is
+	LintianFlags string
+	// FailOn is the lowest severity of tags failing the step
+	FailOn string
+	// Split enables separate lintian runs for source and binary packages
+	Split bool
+	// NoUdeb excludes installer packages from linting
+	NoUdeb bool
+	// IndepOnly limits linting to architecture independent packages
+	IndepOnly bool
+	// ReportFile is where all emitted tags are written as JSON
+	ReportFile string
+	// Allow are names of tags never failing the step
+	Allow []string
+}
+
+// Lint function executes "debi", "debc" and "lintian" in container.
+func Lint(dock docker.Engine, n *naming.Naming, lintArgs LintArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Linting package")
+
+	// skip tests
+	if !lintArgs.Enabled {
+		return logger.Skipped()
+	}
+
+	if !lintian.IsSeverity(lintArgs.FailOn) {
+		return logger.Failed(fmt.Errorf("unknown lintian severity: %s", lintArgs.FailOn))
+	}
+
+	logger.Drop()
+
+	args := []docker.ContainerExecArgs{
+		{
+			Name:    n.Container,
+			Cmd:     "debi --with-depends",
+			Network: true,
+			AsRoot:  true,
+		}, {
+			Name: n.Container,
+			Cmd:  "debc",
+		},
+	}
+
+	err := execSequence(dock, args)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	sourceTargets := fmt.Sprintf("../%s_%s.dsc", n.Source, n.VersionNoEpoch)
+	arch := "*"
+	if lintArgs.IndepOnly {
+		arch = "all"
+	}
+
+	binaryTargets := fmt.Sprintf("../*_%s_%s.deb", n.VersionNoEpoch, arch)
+	if !lintArgs.NoUdeb {
+		binaryTargets += fmt.Sprintf(" ../*_%s_%s.udeb", n.VersionNoEpoch, arch)
+	}
+
+	// Without targets lintian checks .changes file of current build
+	runs := []lintianRun{{}}
+	switch {
+	case lintArgs.Split:
+		runs = []lintianRun{
+			{
+				label:   "source",
+				targets: sourceTargets,
+			}, {
+				label:   "binary",
+				targets: binaryTargets,
+			},
+		}
+	case lintArgs.NoUdeb || lintArgs.IndepOnly:
+		runs = []lintianRun{
+			{
+				targets: sourceTargets + " " + binaryTargets,
+			},
+		}
+	}
+
+	tags := make([]lintian.Tag, 0)
+	for _, run := range runs {
+		if run.label != "" {
+			logger.ExtraInfo(run.label)
+			logger.Drop()
+		}
+
+		output, err := runLintian(dock, n, lintArgs.LintianFlags, run.targets)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		tags = append(tags, lintian.Parse(output)...)
+	}
+
+	if lintArgs.ReportFile != "" {
+		report, err := json.MarshalIndent(tags, "", "  ")
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		err = os.WriteFile(lintArgs.ReportFile, append(report, '\n'), 0644)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	tags = lintian.AtLeast(lintian.Without(tags, lintArgs.Allow), lintArgs.FailOn)
+	if len(tags) > 0 {
+		return logger.Failed(fmt.Errorf("lintian emitted %d tags of severity %s or higher", len(tags), lintArgs.FailOn))
+	}
+
+	return logger.Done()
+}
+
+// lintianRun struct represents single lintian invocation.
+type lintianRun struct {
+	label   string
+	targets string
+}
+
+// runLintian function executes lintian on given targets in container
+// and returns its output, which is printed along the way.
+//
+// Targets matching nothing are simply skipped.
+func runLintian(dock docker.Engine, n *naming.Naming, lintianFlags, targets string) (string, error) {
+	logger := log.For(n.Container)
+
+	cmd := "lintian " + lintianFlags
+	if targets != "" {
+		cmd = fmt.Sprintf(`targets=$(ls %s 2>/dev/null); if [ -n "$targets" ]; then lintian %s $targets; fi`, targets, lintianFlags)
+	}
+
+	buffer := new(bytes.Buffer)
+	arg := docker.ContainerExecArgs{
+		Name:   n.Container,
+		Cmd:    cmd,
+		Output: io.MultiWriter(logger.Output, buffer),
+	}
+
+	// Exit status 1 means that lintian found tags,
+	// it's up to us to decide if they matter
+	err := dock.ContainerExec(arg)
+	var execErr *docker.ExecError
+	if err != nil && !(errors.As(err, &execErr) && execErr.ExitCode == 1) {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
@@ -0,0 +1,492 @@
+package steps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/dpvpro/deber/pkg/control"
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+	"pault.ag/go/debian/version"
+)
+
+// PackageArgs struct represents arguments
+// passed to Package().
+type PackageArgs struct {
+	// DpkgFlags are passed to dpkg-buildpackage as is
+	DpkgFlags string
+	// Network enables network access during build
+	Network bool
+	// Tests enables running tests during build
+	Tests bool
+	// Profiles are space separated build profiles
+	Profiles string
+	// ChangesDistribution overrides distribution in .changes file
+	ChangesDistribution string
+	// ChangesUrgency overrides urgency in .changes file
+	ChangesUrgency string
+	// GpgAgent enables signing with host's GPG agent
+	GpgAgent bool
+	// SignKey is the key used for signing, if empty
+	// dpkg-buildpackage picks one on its own
+	SignKey string
+	// IndepOnly limits build to architecture independent packages
+	IndepOnly bool
+	// Locale is set in build environment, generated if needed
+	Locale string
+	// ReadOnlySource makes debhelper build out of source tree
+	ReadOnlySource bool
+	// TmpDir is temporary directory of build, made if needed
+	TmpDir string
+	// Umask of build process, octal
+	Umask string
+	// TestOnly runs only build target, along with tests,
+	// without producing packages
+	TestOnly bool
+	// LanguageCaches are names of mounted language caches
+	LanguageCaches []string
+	// OnlyPackages limits build to given binary packages
+	OnlyPackages []string
+	// VerifyArchitecture is architecture built binary packages
+	// have to be for (or all), not verified if empty
+	VerifyArchitecture string
+	// Trace runs dpkg-buildpackage under strace
+	Trace bool
+	// TraceOptions are passed to strace as is
+	TraceOptions string
+}
+
+// Package function executes "dpkg-buildpackage" in container.
+// Enables network back.
+func Package(dock docker.Engine, n *naming.Naming, pkgArgs PackageArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Packaging software")
+
+	if !localeRegexp.MatchString(pkgArgs.Locale) {
+		return logger.Failed(fmt.Errorf("invalid locale: %s", pkgArgs.Locale))
+	}
+
+	for _, pkg := range pkgArgs.OnlyPackages {
+		if !packageNameRegexp.MatchString(pkg) || strings.Contains(pkg, ":") {
+			return logger.Failed(fmt.Errorf("invalid package name: %s", pkg))
+		}
+	}
+
+	logger.Drop()
+
+	if pkgArgs.Umask != "" {
+		_, err := parseUmask(pkgArgs.Umask)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	if pkgArgs.TmpDir != "" {
+		err := validateTmpDir(pkgArgs.TmpDir)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		args := docker.ContainerExecArgs{
+			Name:   n.Container,
+			Cmd:    fmt.Sprintf("mkdir -p %s && chmod 1777 %s", pkgArgs.TmpDir, pkgArgs.TmpDir),
+			AsRoot: true,
+		}
+		err = dock.ContainerExec(args)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	if !slices.Contains([]string{"C", "C.UTF-8", "POSIX"}, pkgArgs.Locale) {
+		args := docker.ContainerExecArgs{
+			Name:   n.Container,
+			Cmd:    fmt.Sprintf("grep '^%s ' /usr/share/i18n/SUPPORTED > /etc/locale.gen && locale-gen", pkgArgs.Locale),
+			AsRoot: true,
+		}
+		err := dock.ContainerExec(args)
+		if err != nil {
+			return logger.Failed(fmt.Errorf("locale %s can't be generated: %w", pkgArgs.Locale, err))
+		}
+	}
+
+	dpkgFlags := pkgArgs.DpkgFlags
+	if pkgArgs.IndepOnly {
+		dpkgFlags = indepOnly(dpkgFlags)
+	}
+	signing := pkgArgs.GpgAgent && !pkgArgs.TestOnly
+	if signing {
+		dpkgFlags = withSigning(dpkgFlags)
+	}
+
+	cmd := "dpkg-buildpackage " + dpkgFlags
+	if pkgArgs.TestOnly {
+		cmd = "dpkg-buildpackage --rules-target=build"
+	}
+	if n.Arch != "" {
+		cmd += " -a" + n.Arch
+	}
+	traceFile := filepath.Join(naming.ContainerBuildDir, traceFileName(n))
+	if pkgArgs.Trace {
+		cmd = fmt.Sprintf("strace %s -o %s %s", pkgArgs.TraceOptions, traceFile, cmd)
+	}
+	if pkgArgs.ChangesDistribution != "" && !pkgArgs.TestOnly {
+		cmd += " --changes-option=-D" + pkgArgs.ChangesDistribution
+	}
+	if pkgArgs.ChangesUrgency != "" && !pkgArgs.TestOnly {
+		cmd += " --changes-option=-u" + pkgArgs.ChangesUrgency
+	}
+	if pkgArgs.Profiles != "" {
+		cmd = "DEB_BUILD_PROFILES='" + pkgArgs.Profiles + "' " + cmd
+	}
+	if !pkgArgs.Tests && !pkgArgs.TestOnly {
+		cmd = "DEB_BUILD_OPTIONS='nocheck nodoc notest' " + cmd
+	}
+	cmd = fmt.Sprintf("LC_ALL=%s LANG=%s %s", pkgArgs.Locale, pkgArgs.Locale, cmd)
+	if pkgArgs.TmpDir != "" {
+		cmd = "TMPDIR=" + pkgArgs.TmpDir + " " + cmd
+	}
+	for _, name := range pkgArgs.LanguageCaches {
+		cmd = LanguageCaches[name] + "=" + filepath.Join(naming.ContainerLanguageCacheDir, name) + " " + cmd
+	}
+	dhOptions := make([]string, 0)
+	if pkgArgs.ReadOnlySource {
+		dhOptions = append(dhOptions, "--builddirectory="+filepath.Join(naming.ContainerBuildDir, outOfTreeDir))
+	}
+	for _, pkg := range pkgArgs.OnlyPackages {
+		dhOptions = append(dhOptions, "-p"+pkg)
+	}
+	if len(dhOptions) > 0 {
+		cmd = "DH_OPTIONS='" + strings.Join(dhOptions, " ") + "' " + cmd
+	}
+	if signing {
+		if pkgArgs.SignKey != "" {
+			cmd += " --sign-key=" + pkgArgs.SignKey
+		}
+		cmd = withGnupgHome(cmd)
+	}
+	if pkgArgs.Umask != "" {
+		cmd = "umask " + pkgArgs.Umask + "; " + cmd
+	}
+	args := docker.ContainerExecArgs{
+		Name:    n.Container,
+		Cmd:     cmd,
+		Network: pkgArgs.Network,
+	}
+	err := dock.ContainerExec(args)
+	if pkgArgs.Trace {
+		logger.ExtraInfo("trace written to " + filepath.Join(n.BuildDir, traceFileName(n)))
+		logger.Drop()
+	}
+	if err != nil && pkgArgs.TmpDir != "" && isTmpDirFull(dock, n, pkgArgs.TmpDir) {
+		return logger.Failed(fmt.Errorf("%w: no space left in temporary directory %s", err, pkgArgs.TmpDir))
+	}
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	if pkgArgs.TestOnly {
+		return logger.Done()
+	}
+
+	if pkgArgs.VerifyArchitecture != "" {
+		err = verifyArchitectures(dock, n, pkgArgs.VerifyArchitecture)
+		if err != nil {
+			return logger.Failed(err)
+		}
+	}
+
+	// Build succeeded already, so sizes are just left out
+	sizes, err := PackageSizes(dock, n)
+	if err != nil {
+		logger.Warning(fmt.Errorf("sizes of packages unknown: %w", err))
+	}
+
+	for _, size := range sizes {
+		info := fmt.Sprintf("%s %s, installed %s", size.File, units.HumanSize(float64(size.Size)), units.HumanSize(float64(size.InstalledSize)))
+		if size.PreviousSize >= 0 {
+			info += fmt.Sprintf(", %+d bytes since %s", size.Size-size.PreviousSize, size.PreviousVersion)
+		}
+
+		logger.ExtraInfo(info)
+		logger.Drop()
+	}
+
+	return logger.Done()
+}
+
+// traceFileName function returns name of file
+// strace writes trace of build to.
+func traceFileName(n *naming.Naming) string {
+	return fmt.Sprintf("%s_%s.strace", n.Source, n.VersionNoEpoch)
+}
+
+// isTmpDirFull function checks if there is less
+// than a mebibyte available in temporary directory.
+func isTmpDirFull(dock docker.Engine, n *naming.Naming, dir string) bool {
+	buffer := new(bytes.Buffer)
+	args := docker.ContainerExecArgs{
+		Name:   n.Container,
+		Cmd:    "df -P -k " + dir + " | tail -n 1",
+		Output: buffer,
+	}
+	err := dock.ContainerExec(args)
+	if err != nil {
+		return false
+	}
+
+	fields := strings.Fields(buffer.String())
+	if len(fields) < 4 {
+		return false
+	}
+
+	available, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return available < 1024
+}
+
+// PackageSize struct represents sizes of built binary package.
+type PackageSize struct {
+	// File is the name of .deb file
+	File string
+	// Size is the size of .deb file in bytes
+	Size int64
+	// InstalledSize is the size of installed package in bytes
+	InstalledSize int64
+	// PreviousSize is the size of .deb file of previously
+	// archived version, -1 if there is none
+	PreviousSize int64
+	// PreviousVersion is the previously archived version
+	PreviousVersion string
+}
+
+// verifyArchitectures function checks if binary packages in build
+// directory are built for given architecture or are independent,
+// reporting each mismatching one.
+//
+// Architectures are read with "dpkg-deb" in container.
+func verifyArchitectures(dock docker.Engine, n *naming.Naming, arch string) error {
+	logger := log.For(n.Container)
+
+	files, err := filepath.Glob(filepath.Join(n.BuildDir, fmt.Sprintf("*_%s_*.*deb", n.VersionNoEpoch)))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	cmds := make([]string, 0, len(files))
+	for _, file := range files {
+		name := filepath.Base(file)
+		cmds = append(cmds, fmt.Sprintf("echo File: %s; dpkg-deb --field ../%s Architecture; echo", name, name))
+	}
+
+	buffer := new(bytes.Buffer)
+	args := docker.ContainerExecArgs{
+		Name:   n.Container,
+		Cmd:    strings.Join(cmds, "; "),
+		Output: buffer,
+	}
+	err = dock.ContainerExec(args)
+	if err != nil {
+		return err
+	}
+
+	paragraphs, err := control.Parse(buffer)
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+	for _, paragraph := range paragraphs {
+		architecture := paragraph["Architecture"]
+		if architecture == arch || architecture == "all" {
+			continue
+		}
+
+		logger.ExtraInfo(fmt.Sprintf("%s is built for %s, expected %s", paragraph["File"], architecture, arch))
+		logger.Drop()
+		mismatches++
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%d packages built for architecture other than %s", mismatches, arch)
+	}
+
+	return nil
+}
+
+// PackageSizes function returns sizes of binary packages
+// in build directory, along with sizes of their previously
+// archived versions.
+//
+// Installed sizes are read with "dpkg-deb" in container.
+func PackageSizes(dock docker.Engine, n *naming.Naming) ([]PackageSize, error) {
+	files, err := filepath.Glob(filepath.Join(n.BuildDir, fmt.Sprintf("*_%s_*.*deb", n.VersionNoEpoch)))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	cmds := make([]string, 0, len(files))
+	for _, file := range files {
+		name := filepath.Base(file)
+		cmds = append(cmds, fmt.Sprintf("echo File: %s; dpkg-deb --field ../%s Installed-Size; echo", name, name))
+	}
+
+	buffer := new(bytes.Buffer)
+	args := docker.ContainerExecArgs{
+		Name:   n.Container,
+		Cmd:    strings.Join(cmds, "; "),
+		Output: buffer,
+	}
+	err = dock.ContainerExec(args)
+	if err != nil {
+		return nil, err
+	}
+
+	paragraphs, err := control.Parse(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	previousVersion, err := previousArchived(n)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make([]PackageSize, 0, len(paragraphs))
+	for _, paragraph := range paragraphs {
+		info, err := os.Stat(filepath.Join(n.BuildDir, paragraph["File"]))
+		if err != nil {
+			return nil, err
+		}
+
+		// Installed-Size is given in kibibytes
+		installedSize, err := strconv.ParseInt(paragraph["Installed-Size"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid Installed-Size: %w", paragraph["File"], err)
+		}
+
+		size := PackageSize{
+			File:            paragraph["File"],
+			Size:            info.Size(),
+			InstalledSize:   installedSize * 1024,
+			PreviousSize:    -1,
+			PreviousVersion: previousVersion,
+		}
+
+		if previousVersion != "" {
+			name, _, _ := strings.Cut(size.File, "_")
+			arch := size.File[strings.LastIndex(size.File, "_"):]
+			previous := filepath.Join(n.PackagesSourceDir, previousVersion, name+"_*"+arch)
+
+			matches, _ := filepath.Glob(previous)
+			if len(matches) > 0 {
+				info, err := os.Stat(matches[0])
+				if err != nil {
+					return nil, err
+				}
+				size.PreviousSize = info.Size()
+			}
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+// previousArchived function returns highest archived
+// version of the source lower than the current one,
+// or empty string if there isn't any.
+func previousArchived(n *naming.Naming) (string, error) {
+	current, err := version.Parse(n.Version)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(n.PackagesSourceDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var previous *version.Version
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		v, err := version.Parse(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if version.Compare(v, current) < 0 && (previous == nil || version.Compare(v, *previous) > 0) {
+			previous = &v
+		}
+	}
+
+	if previous == nil {
+		return "", nil
+	}
+
+	return previous.String(), nil
+}
+
+// indepOnly function replaces build type flags of dpkg-buildpackage
+// with one building only architecture independent packages.
+func indepOnly(dpkgFlags string) string {
+	buildTypes := []string{"-b", "-B", "-A", "-S", "-F", "-G", "-g"}
+
+	fields := strings.Fields(dpkgFlags)
+	fields = slices.DeleteFunc(fields, func(field string) bool {
+		return slices.Contains(buildTypes, field) || strings.HasPrefix(field, "--build=")
+	})
+	fields = append(fields, "-A")
+
+	return strings.Join(fields, " ")
+}
+
+// withSigning function drops flags disabling signing
+// from dpkg-buildpackage flags.
+func withSigning(dpkgFlags string) string {
+	unsigned := []string{"-uc", "-us", "--unsigned-changes", "--unsigned-source", "--no-sign"}
+
+	fields := strings.Fields(dpkgFlags)
+	fields = slices.DeleteFunc(fields, func(field string) bool {
+		return slices.Contains(unsigned, field)
+	})
+
+	return strings.Join(fields, " ")
+}
+
+// withGnupgHome function prepends command with preparation
+// of temporary GnuPG home directory, with host's public keyring
+// and link to agent socket, and runs it using that directory.
+func withGnupgHome(cmd string) string {
+	return strings.Join([]string{
+		"mkdir -p -m 700 " + gnupgHome,
+		"cp " + naming.ContainerGnupgDir + "/pubring.* " + naming.ContainerGnupgDir + "/trustdb.gpg " + gnupgHome + " 2>/dev/null",
+		"ln -sf " + naming.ContainerGpgAgentSocket + " " + gnupgHome + "/S.gpg-agent",
+		"GNUPGHOME=" + gnupgHome + " " + cmd,
+	}, "; ")
+}
@@ -0,0 +1,123 @@
+package steps
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+// SignArgs struct represents arguments
+// passed to Sign().
+type SignArgs struct {
+	// Enabled enables the step
+	Enabled bool
+	// Key is id of the key packages are signed with
+	Key string
+}
+
+// Sign function executes "debsign" in container,
+// signing .changes files of current build along with
+// files they list, using host's GPG agent.
+func Sign(dock docker.Engine, n *naming.Naming, signArgs SignArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Signing package")
+
+	if !signArgs.Enabled {
+		return logger.Skipped()
+	}
+
+	if signArgs.Key == "" {
+		return logger.Failed(errors.New("no key to sign packages with"))
+	}
+
+	files, err := filepath.Glob(filepath.Join(n.BuildDir, fmt.Sprintf("*_%s_*.changes", n.VersionNoEpoch)))
+	if err != nil {
+		return logger.Failed(err)
+	}
+	if len(files) == 0 {
+		return logger.Failed(errors.New(".changes file not found"))
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+
+	args := docker.ContainerExecArgs{
+		Name:    n.Container,
+		Cmd:     withGnupgHome("debsign --no-conf --no-re-sign -k" + signArgs.Key + " " + strings.Join(names, " ")),
+		WorkDir: naming.ContainerBuildDir,
+	}
+	err = dock.ContainerExec(args)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	return logger.Done()
+}
+
+// SigningKey function returns fingerprint of host's secret key
+// with user ID matching email of given maintainer, falling back
+// to the first secret key, which is gpg's default one.
+func SigningKey(maintainer string) (string, error) {
+	args := []string{"--batch", "--with-colons", "--list-secret-keys"}
+
+	address, err := mail.ParseAddress(maintainer)
+	if err == nil {
+		output, err := exec.Command("gpg", append(args, "<"+address.Address+">")...).Output()
+		if err == nil {
+			fingerprint := firstFingerprint(string(output))
+			if fingerprint != "" {
+				return fingerprint, nil
+			}
+		}
+	}
+
+	output, err := exec.Command("gpg", args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("gpg: %w", err)
+	}
+
+	fingerprint := firstFingerprint(string(output))
+	if fingerprint == "" {
+		return "", errors.New("no secret key found for signing")
+	}
+
+	return fingerprint, nil
+}
+
+// firstFingerprint function returns fingerprint of the first
+// primary key in gpg's colon delimited output.
+func firstFingerprint(output string) string {
+	primary := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, ":")
+		if fields[0] == "sec" {
+			primary = true
+			continue
+		}
+		if primary && fields[0] == "fpr" && len(fields) > 9 {
+			return fields[9]
+		}
+	}
+
+	return ""
+}
+
+// gpgconfDir function asks gpgconf on host for given directory.
+func gpgconfDir(name string) (string, error) {
+	output, err := exec.Command("gpgconf", "--list-dirs", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("gpgconf: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
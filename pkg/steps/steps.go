@@ -3,537 +3,329 @@
 package steps
 
 import (
-	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"slices"
-	"strings"
-	"time"
+	"regexp"
 
-	"github.com/docker/docker/api/types/mount"
 	"github.com/dpvpro/deber/pkg/docker"
-	"github.com/dpvpro/deber/pkg/dockerfile"
-	"github.com/dpvpro/deber/pkg/dockerhub"
 	"github.com/dpvpro/deber/pkg/log"
 	"github.com/dpvpro/deber/pkg/naming"
-	"github.com/dpvpro/deber/pkg/util"
 )
 
-// Build function determines parent image name by querying DockerHub API
-// for available "debian" and "ubuntu" tags and confronting them with
-// debian/changelog's target distribution.
-//
-// If image exists and is old enough, it will be rebuilt.
-//
-// At last it commands Docker Engine to build image.
-func Build(dock *docker.Docker, n *naming.Naming, maxAge time.Duration) error {
-	log.Info("Building image")
+const (
+	// ImageFromDockerHub constant represents parent image
+	// taken from official DockerHub repositories
+	ImageFromDockerHub = "dockerhub"
+	// ImageFromDebootstrap constant represents parent image
+	// built from root filesystem made by debootstrap
+	ImageFromDebootstrap = "debootstrap"
+
+	// TmpDirTmpfs constant represents temporary directory
+	// backed by in-memory filesystem
+	TmpDirTmpfs = "tmpfs"
+
+	// ResolverApt constant represents apt's own dependency solver
+	ResolverApt = "apt"
+	// ResolverAptitude constant represents aptitude's dependency solver
+	ResolverAptitude = "aptitude"
+	// ResolverAptCudf constant represents external CUDF solver of apt
+	ResolverAptCudf = "apt-cudf"
+
+	// TraceOptions constant is the default filter of strace,
+	// following child processes and tracing only file
+	// and process related system calls
+	TraceOptions = "-f -e trace=%file,%process"
+
+	// SnapshotFormat constant is the layout of snapshot.debian.org timestamps
+	SnapshotFormat = "20060102T150405Z"
+
+	// LabelParent constant is the image label holding parent image name
+	LabelParent = "deber.parent"
+	// LabelDockerfileHash constant is the image label holding
+	// SHA-256 checksum of Dockerfile the image was built from
+	LabelDockerfileHash = "deber.dockerfile.sha256"
+	// LabelSettingsHash constant is the container label holding
+	// SHA-256 checksum of settings the container was created with
+	LabelSettingsHash = "deber.settings.sha256"
+	// LabelSource constant is the container label holding
+	// name of source package the container builds
+	LabelSource = "deber.source"
+	// LabelTarget constant is the image and container label
+	// holding target distribution
+	LabelTarget = "deber.target"
+	// LabelSnapshot constant is the container label holding
+	// timestamp of snapshot.debian.org archive its apt sources
+	// were replaced with
+	LabelSnapshot = "deber.snapshot"
+)
 
-	isImageBuilt, err := dock.IsImageBuilt(n.Image)
-	if err != nil {
-		return log.Failed(err)
-	}
-	if isImageBuilt {
-		age, err := dock.ImageAge(n.Image)
-		if err != nil {
-			return log.Failed(err)
-		}
+const (
+	aptPreferencesDir     = "/etc/apt/preferences.d"
+	aptConfigDir          = "/etc/apt/apt.conf.d"
+	downloadsConfigFile   = "90deber-downloads"
+	replayPreferencesFile = "deber-replay"
+	pinPreferencesFile    = "deber-pin"
+	localPreferencesFile  = "deber-local"
+	gnupgHome             = "/tmp/gnupg"
+	validateScriptDir     = "/tmp"
+	validateScriptFile    = "deber-validate"
+	dependsChecksumFile   = "/var/lib/apt/deber-depends.sha256"
+	referenceDir          = "reference"
+	diffoscopeLogLines    = 50
+	outOfTreeDir          = "out-of-tree"
+	signatureExtension    = ".asc"
+	snapshotSourcesFile   = "snapshot.sources"
+	snapshotURL           = "http://snapshot.debian.org/archive/debian"
+)
 
-		if age < maxAge {
-			return log.Skipped()
-		}
-	}
+var (
+	packageNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?$`)
+	localeRegexp      = regexp.MustCompile(`^[a-zA-Z0-9_.@-]+$`)
+	hostnameRegexp    = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+	rulesTargetRegexp = regexp.MustCompile(`^[a-zA-Z0-9_./%-]+$`)
 
-	repos := []string{"debian", "ubuntu"}
-	repo, err := dockerhub.MatchRepo(repos, n.Target)
-	if err != nil {
-		return log.Failed(err)
+	// LanguageCaches are persistent caches of language package
+	// managers, mapped to environment variables pointing to them
+	LanguageCaches = map[string]string{
+		"go":    "GOMODCACHE",
+		"cargo": "CARGO_HOME",
+		"npm":   "npm_config_cache",
 	}
+)
 
-	dockerFile, err := dockerfile.Parse(repo, n.Target)
-	if err != nil {
-		return log.Failed(err)
-	}
+// Start function commands Docker Engine to start container.
+func Start(dock docker.Engine, n *naming.Naming) error {
+	logger := log.For(n.Container)
 
-	log.Drop()
+	logger.Info("Starting container")
 
-	err = dock.ImageBuild(n.Image, dockerFile)
+	isContainerStarted, err := dock.IsContainerStarted(n.Container)
 	if err != nil {
-		return log.Failed(err)
-	}
-	return log.Done()
-}
-
-// Create function commands Docker Engine to create container.
-//
-// If extra packages are provided, it checks if they are correct
-// and mounts them.
-//
-// If container already exists and mounts are different, then it
-// removes the old one and creates new with proper mounts.
-//
-// Also makes directories on host and moves tarball if needed.
-func Create(dock *docker.Docker, n *naming.Naming, extraPackages []string) error {
-	log.Info("Creating container")
-
-	mounts := []mount.Mount{
-		{
-			Type:   mount.TypeBind,
-			Source: n.SourceDir,
-			Target: naming.ContainerSourceDir,
-		}, {
-			Type:   mount.TypeBind,
-			Source: n.BuildDir,
-			Target: naming.ContainerBuildDir,
-		}, {
-			Type:   mount.TypeBind,
-			Source: n.CacheDir,
-			Target: naming.ContainerCacheDir,
-		},
+		return logger.Failed(err)
 	}
-
-	// Handle extra packages mounting
-	for _, pkg := range extraPackages {
-		// /path/to/directory/with/packages/*
-		files, err := filepath.Glob(pkg)
-		if err != nil {
-			return log.Failed(err)
-		}
-
-		for _, file := range files {
-			source, err := filepath.Abs(file)
-			if err != nil {
-				return log.Failed(err)
-			}
-
-			info, err := os.Stat(source)
-			if info == nil {
-				return log.Failed(err)
-			}
-			if !info.IsDir() && !strings.HasSuffix(source, ".deb") {
-				return log.Failed(errors.New("please specify a directory or .deb file"))
-			}
-
-			target := filepath.Join(naming.ContainerArchiveDir, filepath.Base(source))
-
-			mnt := mount.Mount{
-				Type:     mount.TypeBind,
-				Source:   source,
-				Target:   target,
-				ReadOnly: true,
-			}
-
-			mounts = append(mounts, mnt)
-		}
+	if isContainerStarted {
+		return logger.Skipped()
 	}
 
-	isContainerCreated, err := dock.IsContainerCreated(n.Container)
+	err = dock.ContainerStart(n.Container)
 	if err != nil {
-		return log.Failed(err)
+		return logger.Failed(err)
 	}
-	if isContainerCreated {
-		oldMounts, err := dock.ContainerMounts(n.Container)
-		if err != nil {
-			return log.Failed(err)
-		}
 
-		// Compare old mounts with new ones,
-		// if not equal, then recreate container
-		if util.CompareMounts(oldMounts, mounts) {
-			return log.Skipped()
-		}
-
-		err = dock.ContainerStop(n.Container)
-		if err != nil {
-			return log.Failed(err)
-		}
-
-		err = dock.ContainerRemove(n.Container)
-		if err != nil {
-			return log.Failed(err)
-		}
-	}
+	return logger.Done()
+}
 
-	// Make directories if non existent
-	for _, mnt := range mounts {
-		info, _ := os.Stat(mnt.Source)
-		if info != nil {
-			continue
-		}
+// Rules function executes given target of "debian/rules"
+// in source directory, for debugging of packaging.
+func Rules(dock docker.Engine, n *naming.Naming, target string) error {
+	logger := log.For(n.Container)
 
-		err := os.MkdirAll(mnt.Source, os.ModePerm)
-		if err != nil {
-			return log.Failed(err)
-		}
-	}
+	logger.Info("Running debian/rules " + target)
 
-	user := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
-	args := docker.ContainerCreateArgs{
-		Mounts: mounts,
-		Image:  n.Image,
-		Name:   n.Container,
-		User:   user,
+	if !rulesTargetRegexp.MatchString(target) {
+		return logger.Failed(fmt.Errorf("invalid debian/rules target: %s", target))
 	}
-	err = dock.ContainerCreate(args)
-	if err != nil {
-		return log.Failed(err)
-	}
-
-	return log.Done()
-}
 
-// Start function commands Docker Engine to start container.
-func Start(dock *docker.Docker, n *naming.Naming) error {
-	log.Info("Starting container")
+	logger.Drop()
 
-	isContainerStarted, err := dock.IsContainerStarted(n.Container)
-	if err != nil {
-		return log.Failed(err)
-	}
-	if isContainerStarted {
-		return log.Skipped()
+	args := docker.ContainerExecArgs{
+		Name:    n.Container,
+		Cmd:     "debian/rules " + target,
+		WorkDir: naming.ContainerSourceDir,
 	}
-
-	err = dock.ContainerStart(n.Container)
+	err := dock.ContainerExec(args)
 	if err != nil {
-		return log.Failed(err)
+		return logger.Failed(err)
 	}
 
-	return log.Done()
+	return logger.Done()
 }
 
-// Tarball function finds orig upstream tarballs in parent or build directory
-// and determines which one to use.
-func Tarball(n *naming.Naming) error {
-	log.Info("Finding tarballs")
-
-	// native
-	if n.Version == n.Upstream {
-		return log.Skipped()
-	}
+// Validate function copies user script to container
+// and executes it in source directory, before package is built.
+//
+// Non-zero exit status of script fails the step.
+func Validate(dock docker.Engine, n *naming.Naming, script string) error {
+	logger := log.For(n.Container)
 
-	tarball := fmt.Sprintf("%s_%s.orig.tar", n.Source, n.Upstream)
+	logger.Info("Validating source")
 
-	sourceTarballs := make([]string, 0)
-	sourceFiles, err := os.ReadDir(n.SourceParentDir)
-	if err != nil {
-		return log.Failed(err)
+	if script == "" {
+		return logger.Skipped()
 	}
 
-	buildTarballs := make([]string, 0)
-	buildFiles, err := os.ReadDir(n.BuildDir)
+	content, err := os.ReadFile(script)
 	if err != nil {
-		return log.Failed(err)
+		return logger.Failed(err)
 	}
 
-	extensions := []string{"gz", "xz", "bz2"}
-	for _, f := range sourceFiles {
-		splitFileNameByDot := strings.Split(f.Name(), ".")
-		extensionInFile := splitFileNameByDot[len(splitFileNameByDot)-1]
-		if strings.HasPrefix(f.Name(), tarball) && slices.Contains(extensions, extensionInFile) {
-			sourceTarballs = append(sourceTarballs, f.Name())
-		}
-	}
-
-	for _, f := range buildFiles {
-		if strings.HasPrefix(f.Name(), tarball) {
-			buildTarballs = append(buildTarballs, f.Name())
-		}
+	err = dock.ContainerCopyFile(n.Container, validateScriptDir, validateScriptFile, content, 0755)
+	if err != nil {
+		return logger.Failed(err)
 	}
 
-	if len(buildTarballs) > 1 {
-		return log.Failed(errors.New("multiple tarballs found in build directory"))
-	}
+	logger.Drop()
 
-	// fmt.Println(sourceTarballs)
-	if len(sourceTarballs) > 1 {
-		return log.Failed(errors.New("multiple tarballs found in parent source directory"))
+	args := docker.ContainerExecArgs{
+		Name:    n.Container,
+		Cmd:     filepath.Join(validateScriptDir, validateScriptFile),
+		WorkDir: naming.ContainerSourceDir,
 	}
-
-	if len(sourceTarballs) < 1 && len(buildTarballs) < 1 {
-		return log.Failed(errors.New("upstream tarball not found"))
+	err = dock.ContainerExec(args)
+	if err != nil {
+		return logger.Failed(err)
 	}
 
-	if len(sourceTarballs) == 1 {
-		if len(buildTarballs) == 1 {
-			f := filepath.Join(n.BuildDir, buildTarballs[0])
-			err = os.Remove(f)
-			if err != nil {
-				return log.Failed(err)
-			}
-		}
+	return logger.Done()
+}
 
-		src := filepath.Join(n.SourceParentDir, sourceTarballs[0])
-		dst := filepath.Join(n.BuildDir, sourceTarballs[0])
+// Stop function commands Docker Engine to stop container.
+func Stop(dock docker.Engine, n *naming.Naming) error {
+	logger := log.For(n.Container)
 
-		src, err = filepath.EvalSymlinks(src)
-		if err != nil {
-			return log.Failed(err)
-		}
+	logger.Info("Stopping container")
 
-		err = os.Rename(src, dst)
-		if err != nil {
-			return log.Failed(err)
-		}
-	} else {
-		return log.Skipped()
+	isContainerStopped, err := dock.IsContainerStopped(n.Container)
+	if err != nil {
+		return logger.Failed(err)
 	}
-
-	return log.Done()
-}
-
-// Depends function installs build dependencies of package
-// in container.
-func Depends(dock *docker.Docker, n *naming.Naming, extraPackages []string) error {
-	log.Info("Installing dependencies")
-	log.Drop()
-
-	args := []docker.ContainerExecArgs{
-		{
-			Name:    n.Container,
-			Cmd:     "rm -f a.sources",
-			AsRoot:  true,
-			WorkDir: "/etc/apt/sources.list.d",
-		}, {
-			Name:    n.Container,
-			Cmd:     "echo URIs: file://" + naming.ContainerArchiveDir + " ./ > a.sources",
-			AsRoot:  true,
-			WorkDir: "/etc/apt/sources.list.d",
-			Skip:    extraPackages == nil,
-		}, {
-			Name:    n.Container,
-			Cmd:     "dpkg-scanpackages -m . > Packages",
-			AsRoot:  true,
-			WorkDir: naming.ContainerArchiveDir,
-			Skip:    extraPackages == nil,
-		}, {
-			Name:    n.Container,
-			Cmd:     "apt-get update",
-			AsRoot:  true,
-			Network: true,
-		}, {
-			Name:    n.Container,
-			Cmd:     "apt-get build-dep ./",
-			Network: true,
-			AsRoot:  true,
-		},
+	if isContainerStopped {
+		return logger.Skipped()
 	}
 
-	for _, arg := range args {
-		err := dock.ContainerExec(arg)
-		if err != nil {
-			return log.Failed(err)
-		}
+	err = dock.ContainerStop(n.Container)
+	if err != nil {
+		return logger.Failed(err)
 	}
 
-	return log.Done()
+	return logger.Done()
 }
 
-// Package function executes "dpkg-buildpackage" in container.
-// Enables network back.
-func Package(dock *docker.Docker, n *naming.Naming, dpkgFlags string, withNetwork bool, tests bool) error {
-	log.Info("Packaging software")
-	log.Drop()
+// Remove function commands Docker Engine to remove container
+// along with its anonymous volumes, unless they should be kept.
+func Remove(dock docker.Engine, n *naming.Naming, keepVolumes bool) error {
+	logger := log.For(n.Container)
 
-	cmd := "dpkg-buildpackage " + dpkgFlags
-	if !tests {
-		cmd = "DEB_BUILD_OPTIONS='nocheck nodoc notest' " + cmd
+	logger.Info("Removing container")
+
+	isContainerCreated, err := dock.IsContainerCreated(n.Container)
+	if err != nil {
+		return logger.Failed(err)
 	}
-	args := docker.ContainerExecArgs{
-		Name:    n.Container,
-		Cmd:     cmd,
-		Network: withNetwork,
+	if !isContainerCreated {
+		return logger.Skipped()
 	}
-	err := dock.ContainerExec(args)
+
+	err = dock.ContainerRemove(n.Container, !keepVolumes)
 	if err != nil {
-		return log.Failed(err)
+		return logger.Failed(err)
 	}
 
-	return log.Done()
+	return logger.Done()
 }
 
-// Lint function executes "debi", "debc" and "lintian" in container.
-func Lint(dock *docker.Docker, n *naming.Naming, lintianFlags string, lintian bool) error {
-
-	log.Info("Linting package")
+// Snapshot function exports container's filesystem to tarball,
+// so the state of container can be inspected after it's removed.
+//
+// If path is a directory, tarball is named after container.
+func Snapshot(dock docker.Engine, n *naming.Naming, path string) error {
+	logger := log.For(n.Container)
 
-	// skip tests
-	if !lintian {
-		return log.Skipped()
-	}
+	logger.Info("Snapshotting container")
 
-	log.Drop()
-
-	args := []docker.ContainerExecArgs{
-		{
-			Name:    n.Container,
-			Cmd:     "debi --with-depends",
-			Network: true,
-			AsRoot:  true,
-		}, {
-			Name: n.Container,
-			Cmd:  "debc",
-		}, {
-			Name: n.Container,
-			Cmd:  "lintian" + " " + lintianFlags,
-		},
+	info, _ := os.Stat(path)
+	if info != nil && info.IsDir() {
+		path = filepath.Join(path, n.Container+".tar")
 	}
 
-	for _, arg := range args {
-		err := dock.ContainerExec(arg)
-		if err != nil {
-			return log.Failed(err)
-		}
+	file, err := os.Create(path)
+	if err != nil {
+		return logger.Failed(err)
 	}
 
-	return log.Done()
-}
-
-// Archive function moves successful build to archive if files changed.
-func Archive(n *naming.Naming) error {
-	log.Info("Archiving build")
-
-	// Make needed directories
-	err := os.MkdirAll(n.PackagesVersionDir, os.ModePerm)
+	err = dock.ContainerExport(n.Container, file)
 	if err != nil {
-		return log.Failed(err)
+		file.Close()
+		return logger.Failed(err)
 	}
 
-	// Read files in build directory
-	files, err := os.ReadDir(n.BuildDir)
+	err = file.Close()
 	if err != nil {
-		return log.Failed(err)
+		return logger.Failed(err)
 	}
 
-	log.Drop()
-
-	for _, f := range files {
-		// We don't need directories, only files
-		if f.IsDir() {
-			continue
-		}
-
-		log.ExtraInfo(f.Name())
-
-		sourcePath := filepath.Join(n.BuildDir, f.Name())
-		targetPath := filepath.Join(n.PackagesVersionDir, f.Name())
-
-		sourceFile, err := os.Open(sourcePath)
-		if err != nil {
-			return log.Failed(err)
-		}
-
-		sourceBytes, err := io.ReadAll(sourceFile)
-		if err != nil {
-			return log.Failed(err)
-		}
-
-		sourceStat, err := sourceFile.Stat()
-		if err != nil {
-			return log.Failed(err)
-		}
-
-		// Check if target file already exists
-		targetStat, _ := os.Stat(targetPath)
-		if targetStat != nil {
-			targetFile, err := os.Open(targetPath)
-			if err != nil {
-				return log.Failed(err)
-			}
-
-			targetBytes, err := io.ReadAll(targetFile)
-			if err != nil {
-				return log.Failed(err)
-			}
-
-			sourceChecksum := md5.Sum(sourceBytes)
-			targetChecksum := md5.Sum(targetBytes)
-
-			// Compare checksums of source and target files
-			//
-			// if equal then simply skip copying this file
-			if targetChecksum == sourceChecksum {
-				_ = log.Skipped()
-				continue
-			}
-		}
+	logger.Drop()
+	logger.ExtraInfo(path)
+	return logger.Done()
+}
 
-		// Target file doesn't exist or checksums mismatched
-		err = os.WriteFile(targetPath, sourceBytes, sourceStat.Mode())
-		if err != nil {
-			return log.Failed(err)
-		}
+// ShellOptional function interactively executes shell in container.
+func ShellOptional(dock docker.Engine, n *naming.Naming) error {
+	logger := log.For(n.Container)
 
-		err = sourceFile.Close()
-		if err != nil {
-			return log.Failed(err)
-		}
+	logger.Info("Launching shell")
+	logger.Drop()
 
-		_ = log.Done()
+	args := docker.ContainerExecArgs{
+		Interactive: true,
+		AsRoot:      true,
+		Network:     true,
+		Name:        n.Container,
+	}
+	err := dock.ContainerExec(args)
+	if err != nil {
+		return logger.Failed(err)
 	}
 
-	log.Drop()
-	return log.Done()
+	return logger.Done()
 }
 
-// Stop function commands Docker Engine to stop container.
-func Stop(dock *docker.Docker, n *naming.Naming) error {
-	log.Info("Stopping container")
-
-	isContainerStopped, err := dock.IsContainerStopped(n.Container)
+// copyFile function copies file from src to dst preserving its mode.
+func copyFile(src, dst string) error {
+	source, err := os.Open(src)
 	if err != nil {
-		return log.Failed(err)
-	}
-	if isContainerStopped {
-		return log.Skipped()
+		return err
 	}
+	defer source.Close()
 
-	err = dock.ContainerStop(n.Container)
+	info, err := source.Stat()
 	if err != nil {
-		return log.Failed(err)
+		return err
 	}
 
-	return log.Done()
-}
-
-// Remove function commands Docker Engine to remove container.
-func Remove(dock *docker.Docker, n *naming.Naming) error {
-	log.Info("Removing container")
-
-	isContainerCreated, err := dock.IsContainerCreated(n.Container)
+	target, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
 	if err != nil {
-		return log.Failed(err)
-	}
-	if !isContainerCreated {
-		return log.Skipped()
+		return err
 	}
 
-	err = dock.ContainerRemove(n.Container)
+	_, err = io.Copy(target, source)
 	if err != nil {
-		return log.Failed(err)
+		target.Close()
+		return err
 	}
 
-	return log.Done()
+	return target.Close()
 }
 
-// ShellOptional function interactively executes bash shell in container.
-func ShellOptional(dock *docker.Docker, n *naming.Naming) error {
-	log.Info("Launching shell")
-	log.Drop()
+// execSequence function executes given commands one by one
+// and stops at the first failure, which identifies the failed command.
+func execSequence(dock docker.Engine, args []docker.ContainerExecArgs) error {
+	for _, arg := range args {
+		err := dock.ContainerExec(arg)
+		if err == nil {
+			continue
+		}
 
-	args := docker.ContainerExecArgs{
-		Interactive: true,
-		AsRoot:      true,
-		Network:     true,
-		Name:        n.Container,
-	}
-	err := dock.ContainerExec(args)
-	if err != nil {
-		return log.Failed(err)
+		var execErr *docker.ExecError
+		if errors.As(err, &execErr) {
+			return err
+		}
+
+		return fmt.Errorf("command %q: %w", arg.Cmd, err)
 	}
 
-	return log.Done()
+	return nil
 }
@@ -0,0 +1,119 @@
+package steps_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dpvpro/deber/pkg/naming"
+	"github.com/dpvpro/deber/pkg/steps"
+	"github.com/stretchr/testify/assert"
+)
+
+func tarballNaming(t *testing.T) *naming.Naming {
+	dir := t.TempDir()
+	n := naming.New(naming.Args{
+		Prefix:          "deber",
+		Source:          "foo",
+		Version:         "1.0-1",
+		Upstream:        "1.0",
+		Target:          "unstable",
+		SourceBaseDir:   filepath.Join(dir, "foo"),
+		BuildBaseDir:    filepath.Join(dir, "build"),
+		CacheBaseDir:    filepath.Join(dir, "cache"),
+		PackagesBaseDir: filepath.Join(dir, "packages"),
+	})
+
+	assert.NoError(t, os.MkdirAll(n.SourceDir, 0755))
+	assert.NoError(t, os.MkdirAll(n.BuildDir, 0755))
+
+	return n
+}
+
+func TestTarballZstd(t *testing.T) {
+	n := tarballNaming(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(n.SourceParentDir, "foo_1.0.orig.tar.zst"), []byte("tarball"), 0644))
+
+	err := steps.Tarball(n, steps.TarballArgs{})
+	assert.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(n.BuildDir, "foo_1.0.orig.tar.zst"))
+	assert.NoFileExists(t, filepath.Join(n.SourceParentDir, "foo_1.0.orig.tar.zst"))
+}
+
+func TestTarballComponents(t *testing.T) {
+	n := tarballNaming(t)
+	for _, name := range []string{"foo_1.0.orig.tar.gz", "foo_1.0.orig-docs.tar.gz", "foo_1.0.orig-docs.tar.xz"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(n.SourceParentDir, name), []byte("tarball"), 0644))
+	}
+
+	err := steps.Tarball(n, steps.TarballArgs{Compressions: []string{"xz", "gz"}})
+	assert.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(n.BuildDir, "foo_1.0.orig.tar.gz"))
+	assert.FileExists(t, filepath.Join(n.BuildDir, "foo_1.0.orig-docs.tar.xz"))
+	assert.NoFileExists(t, filepath.Join(n.BuildDir, "foo_1.0.orig-docs.tar.gz"))
+	assert.FileExists(t, filepath.Join(n.SourceParentDir, "foo_1.0.orig-docs.tar.gz"))
+}
+
+func TestDependsChecksumFiles(t *testing.T) {
+	n := tarballNaming(t)
+	assert.NoError(t, os.MkdirAll(filepath.Join(n.SourceDir, "debian"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(n.SourceDir, "debian/control"), []byte("Source: foo\nBuild-Depends: debhelper-compat (= 13)\n"), 0644))
+
+	dir := t.TempDir()
+	args := steps.DependsArgs{
+		ReplayFile:  filepath.Join(dir, "replay"),
+		SourcesList: filepath.Join(dir, "sources.list"),
+	}
+	assert.NoError(t, os.WriteFile(args.ReplayFile, []byte("debhelper=13.11\n"), 0644))
+	assert.NoError(t, os.WriteFile(args.SourcesList, []byte("deb http://deb.debian.org/debian unstable main\n"), 0644))
+
+	before, err := steps.DependsChecksum(n, args)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(args.ReplayFile, []byte("debhelper=13.15\n"), 0644))
+	replayed, err := steps.DependsChecksum(n, args)
+	assert.NoError(t, err)
+	assert.NotEqual(t, before, replayed)
+
+	assert.NoError(t, os.WriteFile(args.SourcesList, []byte("deb http://deb.debian.org/debian testing main\n"), 0644))
+	sourced, err := steps.DependsChecksum(n, args)
+	assert.NoError(t, err)
+	assert.NotEqual(t, replayed, sourced)
+
+	args.Downloads = &steps.Downloads{}
+	reported, err := steps.DependsChecksum(n, args)
+	assert.NoError(t, err)
+	assert.Equal(t, sourced, reported)
+}
+
+func TestDependsChecksumFields(t *testing.T) {
+	// New option has to be added to checksum, or left out on purpose
+	assert.Equal(t, 17, reflect.TypeOf(steps.DependsArgs{}).NumField())
+}
+
+func TestWithSigning(t *testing.T) {
+	tests := []struct {
+		flags    string
+		expected string
+	}{
+		{"-uc -us -b", "-b"},
+		{"-b", "-b"},
+		{"--unsigned-source --unsigned-changes -B", "-B"},
+		{"--no-sign -j4", "-j4"},
+		{"-tc -uc", "-tc"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, steps.WithSigning(test.flags), test.flags)
+	}
+}
+
+func TestHeadLines(t *testing.T) {
+	assert.Equal(t, "a\nb\n", steps.HeadLines("a\nb\n", 2))
+	assert.Equal(t, "a\nb", steps.HeadLines("a\nb", 2))
+	assert.Equal(t, "a\n... 2 more lines in report\n", steps.HeadLines("a\nb\nc\n", 1))
+}
@@ -0,0 +1,390 @@
+package steps
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+var (
+	tarballMutex sync.Mutex
+
+	// tarballExtensions are extensions of recognized
+	// compressed tarballs
+	tarballExtensions = []string{"gz", "xz", "bz2", "lzma", "zst"}
+	componentRegexp   = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+)
+
+// TarballArgs struct represents arguments
+// passed to Tarball().
+type TarballArgs struct {
+	// KeepSource copies tarball from parent directory instead of moving it
+	KeepSource bool
+	// Verify enables verification of tarball signature
+	Verify bool
+	// Compressions are ordered by preference, if there are several tarballs
+	Compressions []string
+	// Path is explicitly given tarball, no search is done then
+	Path string
+}
+
+// Tarball function finds orig upstream tarballs in parent or build directory
+// and determines which one to use.
+func Tarball(n *naming.Naming, tarballArgs TarballArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Finding tarballs")
+
+	// Parent directory may be shared by concurrent builds
+	tarballMutex.Lock()
+	defer tarballMutex.Unlock()
+
+	// native
+	if n.Version == n.Upstream {
+		return logger.Skipped()
+	}
+
+	tarball := fmt.Sprintf("%s_%s.orig.tar", n.Source, n.Upstream)
+
+	if tarballArgs.Path != "" {
+		err := explicitTarball(n, tarball, tarballArgs.Path)
+		if err != nil {
+			return logger.Failed(err)
+		}
+
+		if tarballArgs.Verify {
+			err = verifyTarball(n, filepath.Join(n.BuildDir, tarball+filepath.Ext(tarballArgs.Path)))
+			if err != nil {
+				return logger.Failed(err)
+			}
+		}
+
+		return logger.Done()
+	}
+
+	sourceFiles, err := os.ReadDir(n.SourceParentDir)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	buildFiles, err := os.ReadDir(n.BuildDir)
+	if err != nil {
+		return logger.Failed(err)
+	}
+
+	for _, c := range tarballArgs.Compressions {
+		if !slices.Contains(tarballExtensions, c) {
+			return logger.Failed(fmt.Errorf("unknown tarball compression: %s", c))
+		}
+	}
+
+	sourceTarballs := componentTarballs(n, sourceFiles)
+	buildTarballs := componentTarballs(n, buildFiles)
+
+	// Compression declared by package settles which one to use
+	compression, err := sourceCompression(n)
+	if err != nil {
+		return logger.Failed(err)
+	}
+	compressions := tarballArgs.Compressions
+	if compression != "" {
+		compressions = append([]string{compression}, compressions...)
+	}
+
+	if len(sourceTarballs[""]) < 1 && len(buildTarballs[""]) < 1 {
+		return logger.Failed(errors.New("upstream tarball not found"))
+	}
+
+	// Main tarball goes first, then components
+	components := slices.Collect(maps.Keys(buildTarballs))
+	for component := range sourceTarballs {
+		if !slices.Contains(components, component) {
+			components = append(components, component)
+		}
+	}
+	slices.Sort(components)
+
+	moved := false
+	for _, component := range components {
+		sources, _ := preferTarball(sourceTarballs[component], compressions)
+		builds, leftovers := preferTarball(buildTarballs[component], compressions)
+
+		// Leftovers would confuse dpkg-source
+		for _, name := range leftovers {
+			err = os.Remove(filepath.Join(n.BuildDir, name))
+			if err != nil {
+				return logger.Failed(err)
+			}
+		}
+
+		if len(sources) == 0 {
+			if tarballArgs.Verify && component == "" {
+				err = verifyTarball(n, filepath.Join(n.BuildDir, builds[0]))
+				if err != nil {
+					return logger.Failed(err)
+				}
+			}
+
+			continue
+		}
+
+		err = moveTarball(n, sources[0], builds, tarballArgs.KeepSource)
+		if err != nil {
+			return logger.Failed(err)
+		}
+		moved = true
+
+		if tarballArgs.Verify && component == "" {
+			err = verifyTarball(n, filepath.Join(n.BuildDir, sources[0]))
+			if err != nil {
+				return logger.Failed(err)
+			}
+		}
+	}
+
+	if !moved {
+		return logger.Skipped()
+	}
+
+	return logger.Done()
+}
+
+// componentTarballs function groups orig tarballs among given files
+// by upstream component, main tarball being under empty one.
+//
+// Files are named like foo_1.0.orig.tar.xz for main tarball,
+// and foo_1.0.orig-docs.tar.xz for component ones.
+func componentTarballs(n *naming.Naming, files []os.DirEntry) map[string][]string {
+	prefix := fmt.Sprintf("%s_%s.orig", n.Source, n.Upstream)
+	tarballs := make(map[string][]string)
+
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f.Name(), prefix)
+		if !ok {
+			continue
+		}
+
+		component, extension, ok := strings.Cut(rest, ".tar.")
+		if !ok || !slices.Contains(tarballExtensions, extension) {
+			continue
+		}
+
+		if component != "" {
+			component, ok = strings.CutPrefix(component, "-")
+			if !ok || !componentRegexp.MatchString(component) {
+				continue
+			}
+		}
+
+		tarballs[component] = append(tarballs[component], f.Name())
+	}
+
+	return tarballs
+}
+
+// moveTarball function moves, or copies if source should be kept,
+// given tarball from parent directory to build directory,
+// along with its signature, replacing tarballs already there.
+func moveTarball(n *naming.Naming, tarball string, replaced []string, keepSource bool) error {
+	for _, name := range replaced {
+		f := filepath.Join(n.BuildDir, name)
+		err := os.Remove(f)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(f + signatureExtension)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	for _, name := range []string{tarball, tarball + signatureExtension} {
+		src := filepath.Join(n.SourceParentDir, name)
+		dst := filepath.Join(n.BuildDir, name)
+
+		src, err := filepath.EvalSymlinks(src)
+		if errors.Is(err, os.ErrNotExist) && name != tarball {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if keepSource {
+			err = copyFile(src, dst)
+		} else {
+			err = os.Rename(src, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// explicitTarball function copies given tarball, and its signature
+// if present, to build directory under expected name, replacing
+// tarballs already there.
+func explicitTarball(n *naming.Naming, tarball, path string) error {
+	logger := log.For(n.Container)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	extension := strings.TrimPrefix(filepath.Ext(path), ".")
+	if !slices.Contains(tarballExtensions, extension) {
+		return fmt.Errorf("%s is not a compressed tarball", path)
+	}
+
+	name := tarball + "." + extension
+	if filepath.Base(path) != name {
+		logger.Drop()
+		logger.ExtraInfo(fmt.Sprintf("%s doesn't match expected name, using it as %s", filepath.Base(path), name))
+		logger.Drop()
+	}
+
+	buildFiles, err := os.ReadDir(n.BuildDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range buildFiles {
+		if strings.HasPrefix(f.Name(), tarball) {
+			err = os.Remove(filepath.Join(n.BuildDir, f.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = copyFile(path, filepath.Join(n.BuildDir, name))
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(path+signatureExtension, filepath.Join(n.BuildDir, name+signatureExtension))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// preferTarball function picks tarball compressed with the first
+// matching compression, or the first one if none matches, and
+// returns it along with the rest.
+func preferTarball(tarballs, compressions []string) ([]string, []string) {
+	if len(tarballs) < 2 {
+		return tarballs, nil
+	}
+
+	tarballs = slices.Clone(tarballs)
+	slices.Sort(tarballs)
+
+	index := 0
+	for _, compression := range compressions {
+		i := slices.IndexFunc(tarballs, func(name string) bool {
+			return strings.HasSuffix(name, "."+compression)
+		})
+		if i >= 0 {
+			index = i
+			break
+		}
+	}
+
+	preferred := tarballs[index]
+	rest := slices.Delete(tarballs, index, index+1)
+
+	return []string{preferred}, rest
+}
+
+// sourceCompression function returns extension of compression
+// declared in debian/source/options, if any.
+func sourceCompression(n *naming.Naming) (string, error) {
+	content, err := os.ReadFile(filepath.Join(n.SourceDir, "debian/source/options"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	extensions := map[string]string{
+		"gzip":  "gz",
+		"bzip2": "bz2",
+		"lzma":  "lzma",
+		"xz":    "xz",
+		"zstd":  "zst",
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(name) != "compression" {
+			continue
+		}
+
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		extension, ok := extensions[value]
+		if !ok {
+			return "", fmt.Errorf("debian/source/options: unknown compression: %s", value)
+		}
+
+		return extension, nil
+	}
+
+	return "", nil
+}
+
+// verifyTarball function checks signature of tarball
+// with upstream signing key from debian/upstream/signing-key.asc.
+//
+// Key is dearmored to temporary keyring, as gpgv doesn't
+// take armored ones.
+func verifyTarball(n *naming.Naming, tarball string) error {
+	signature := tarball + signatureExtension
+	_, err := os.Stat(signature)
+	if err != nil {
+		return fmt.Errorf("tarball signature not found: %w", err)
+	}
+
+	key := filepath.Join(n.SourceDir, "debian/upstream/signing-key.asc")
+	_, err = os.Stat(key)
+	if err != nil {
+		return fmt.Errorf("upstream signing key not found: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", n.Prefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	keyring := filepath.Join(dir, "keyring.gpg")
+	output, err := exec.Command("gpg", "--batch", "--output", keyring, "--dearmor", key).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gpg --dearmor: %w: %s", err, output)
+	}
+
+	output, err = exec.Command("gpgv", "--keyring", keyring, signature, tarball).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("invalid tarball signature: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
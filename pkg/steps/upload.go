@@ -0,0 +1,72 @@
+package steps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpvpro/deber/pkg/log"
+	"github.com/dpvpro/deber/pkg/naming"
+)
+
+// UploadArgs struct represents arguments
+// passed to Upload().
+type UploadArgs struct {
+	// Target is dput host packages are uploaded to,
+	// step is skipped if empty
+	Target string
+	// Config is dput configuration file, dput's
+	// default ones are read if empty
+	Config string
+}
+
+// Upload function runs "dput" on host, uploading archived
+// .changes files of current build to given target.
+//
+// Output of dput on standard error is reported on failure.
+func Upload(n *naming.Naming, uploadArgs UploadArgs) error {
+	logger := log.For(n.Container)
+
+	logger.Info("Uploading package")
+
+	if uploadArgs.Target == "" {
+		return logger.Skipped()
+	}
+
+	_, err := exec.LookPath("dput")
+	if err != nil {
+		return logger.Failed(errors.New("dput not found on host, install it first"))
+	}
+
+	files, err := filepath.Glob(filepath.Join(n.PackagesVersionDir, fmt.Sprintf("*_%s_*.changes", n.VersionNoEpoch)))
+	if err != nil {
+		return logger.Failed(err)
+	}
+	if len(files) == 0 {
+		return logger.Failed(errors.New(".changes file not found in archive"))
+	}
+
+	args := make([]string, 0)
+	if uploadArgs.Config != "" {
+		args = append(args, "-c", uploadArgs.Config)
+	}
+	args = append(args, uploadArgs.Target)
+	args = append(args, files...)
+
+	logger.Drop()
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("dput", args...)
+	cmd.Stdout = logger.Output
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return logger.Failed(fmt.Errorf("dput: %w: %s", err, strings.TrimSpace(stderr.String())))
+	}
+
+	return logger.Done()
+}
@@ -3,6 +3,7 @@ package util
 
 import (
 	"github.com/docker/docker/api/types/mount"
+	"golang.org/x/sys/unix"
 	"slices"
 )
 
@@ -21,3 +22,16 @@ func CompareMounts(a, b []mount.Mount) bool {
 
 	return matches == len(a)
 }
+
+// FreeSpace function returns number of bytes available
+// to unprivileged user on filesystem containing given path
+func FreeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/naming"
+	"github.com/dpvpro/deber/pkg/steps"
+)
+
+// provenanceSchema identifies format of provenance document,
+// bumped on incompatible changes
+const provenanceSchema = "https://github.com/dpvpro/deber/provenance/v1"
+
+// provenance is document describing how packages were built.
+type provenance struct {
+	Schema     string           `json:"schema"`
+	Builder    provenanceTool   `json:"builder"`
+	Invocation provenanceInvoke `json:"invocation"`
+	Builds     []provenanceSet  `json:"builds"`
+}
+
+// provenanceTool identifies deber itself.
+type provenanceTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// provenanceInvoke describes how deber was run.
+type provenanceInvoke struct {
+	Args         []string `json:"args"`
+	DpkgFlags    string   `json:"dpkgFlags"`
+	LintianFlags string   `json:"lintianFlags"`
+	Lintian      bool     `json:"lintian"`
+	Snapshot     string   `json:"snapshot,omitempty"`
+	GitRef       string   `json:"gitRef,omitempty"`
+}
+
+// provenanceSet describes single successful build for a target.
+type provenanceSet struct {
+	Source       string               `json:"source"`
+	Version      string               `json:"version"`
+	Target       string               `json:"target"`
+	Image        string               `json:"image"`
+	ImageDigest  string               `json:"imageDigest"`
+	Parent       string               `json:"parent"`
+	ParentDigest string               `json:"parentDigest"`
+	Profiles     string               `json:"profiles"`
+	SourceCommit string               `json:"sourceCommit,omitempty"`
+	Artifacts    []provenanceArtifact `json:"artifacts"`
+	FinishedAt   time.Time            `json:"finishedAt"`
+}
+
+// provenanceArtifact is file produced by build.
+type provenanceArtifact struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	provenances     = make(map[string]provenanceSet)
+	provenanceMutex sync.Mutex
+)
+
+// recordProvenance gathers metadata of successful build
+// of a source for a target, replacing the one of previous attempt.
+func recordProvenance(dock docker.Engine, n *naming.Naming) error {
+	labels, err := dock.ImageLabels(n.Image)
+	if err != nil {
+		return err
+	}
+
+	imageDigest, err := dock.ImageDigest(n.Image)
+	if err != nil {
+		return err
+	}
+
+	parent := labels[steps.LabelParent]
+	parentDigest := ""
+	if parent != "" {
+		parentDigest, err = dock.ImageDigest(parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	buildProfiles, err := resolveProfiles(n.Target, *profiles, *targetProfs)
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := hashArtifacts(n.BuildDir)
+	if err != nil {
+		return err
+	}
+
+	set := provenanceSet{
+		Source:       n.Source,
+		Version:      n.Version,
+		Target:       n.Target,
+		Image:        n.Image,
+		ImageDigest:  imageDigest,
+		Parent:       parent,
+		ParentDigest: parentDigest,
+		Profiles:     buildProfiles,
+		SourceCommit: sourceCommit(n.SourceDir),
+		Artifacts:    artifacts,
+		FinishedAt:   time.Now().UTC(),
+	}
+
+	provenanceMutex.Lock()
+	defer provenanceMutex.Unlock()
+
+	provenances[n.Source+"/"+n.Target] = set
+
+	return nil
+}
+
+// hashArtifacts returns SHA-256 checksums of files in build directory.
+func hashArtifacts(dir string) ([]provenanceArtifact, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := make([]provenanceArtifact, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		file, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		artifacts = append(artifacts, provenanceArtifact{
+			Name:   entry.Name(),
+			SHA256: fmt.Sprintf("%x", hash.Sum(nil)),
+		})
+	}
+
+	return artifacts, nil
+}
+
+// sourceCommit returns git commit checked out in source directory,
+// or nothing if it's not a git repository or git isn't installed.
+func sourceCommit(dir string) string {
+	output, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// writeProvenance writes recorded builds to file as JSON.
+func writeProvenance(path string) error {
+	provenanceMutex.Lock()
+	defer provenanceMutex.Unlock()
+
+	if len(provenances) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(provenances))
+	for key := range provenances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	document := provenance{
+		Schema: provenanceSchema,
+		Builder: provenanceTool{
+			Name:    Program,
+			Version: Version,
+		},
+		Invocation: provenanceInvoke{
+			Args:         os.Args[1:],
+			DpkgFlags:    *dpkgFlags,
+			LintianFlags: *lintianFlags,
+			Lintian:      *lint,
+			Snapshot:     *snapshot,
+			GitRef:       *gitRef,
+		},
+		Builds: make([]provenanceSet, 0, len(keys)),
+	}
+	for _, key := range keys {
+		document.Builds = append(document.Builds, provenances[key])
+	}
+
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
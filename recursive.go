@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpvpro/deber/pkg/control"
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/spf13/pflag"
+)
+
+// source holds what's needed to order builds
+// of source packages found under a directory.
+type source struct {
+	dir      string
+	name     string
+	binaries []string
+	depends  []string
+}
+
+// buildRecursive runs pipeline for every source package found
+// under given directory, so that packages needed to build other
+// ones are built (and preferred when installing dependencies) first.
+//
+// Sources depending on failed ones are skipped.
+func buildRecursive(dock docker.Engine, dir string) error {
+	if *shell {
+		return errors.New("shell can't be launched for multiple sources")
+	}
+
+	sources, err := findSources(dir)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no source packages found under %s", dir)
+	}
+
+	sources, err = orderSources(sources)
+	if err != nil {
+		return err
+	}
+
+	results := make([]result, len(sources))
+	built := make([]string, 0)
+
+	for i, src := range sources {
+		results[i].target = src.name
+
+		// Only dependencies of this source are linked
+		localSources = make([]string, 0)
+		for _, dep := range src.depends {
+			if slices.Contains(built, dep) {
+				localSources = append(localSources, dep)
+			}
+		}
+
+		if len(localSources) != len(src.depends) {
+			results[i].status = statusSkipped
+			continue
+		}
+
+		err = resetPackageConfig()
+		if err != nil {
+			return err
+		}
+
+		begin := time.Now()
+		err = buildSource(dock, src.dir)
+		results[i].duration = time.Since(begin)
+
+		if err != nil {
+			results[i].status = statusFailed
+			results[i].err = err
+			continue
+		}
+
+		results[i].status = statusDone
+		built = append(built, src.name)
+	}
+
+	return summarize("source", results)
+}
+
+// findSources walks directory looking for debian/control files
+// and parses names of source, binary packages and build dependencies.
+func findSources(dir string) ([]source, error) {
+	sources := make([]source, 0)
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() || entry.Name() != "debian" {
+			return nil
+		}
+
+		_, err = os.Stat(filepath.Join(path, "changelog"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		paragraphs, err := control.ParseFile(filepath.Join(path, "control"))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if len(paragraphs) == 0 {
+			return fmt.Errorf("%s: debian/control is empty", path)
+		}
+
+		src := source{
+			dir:  filepath.Dir(path),
+			name: paragraphs[0]["Source"],
+		}
+		for _, binary := range paragraphs[1:] {
+			src.binaries = append(src.binaries, binary["Package"])
+		}
+		for _, field := range []string{"Build-Depends", "Build-Depends-Arch", "Build-Depends-Indep"} {
+			src.depends = append(src.depends, relationNames(paragraphs[0][field])...)
+		}
+
+		sources = append(sources, src)
+
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// relationNames returns package names mentioned in relationship field,
+// including alternatives.
+func relationNames(field string) []string {
+	names := make([]string, 0)
+
+	for _, relation := range strings.FieldsFunc(field, func(r rune) bool { return r == ',' || r == '|' }) {
+		name := strings.TrimSpace(relation)
+		name, _, _ = strings.Cut(name, " ")
+		name, _, _ = strings.Cut(name, "(")
+		name, _, _ = strings.Cut(name, "[")
+		name, _, _ = strings.Cut(name, "<")
+		name, _, _ = strings.Cut(name, ":")
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// orderSources sorts sources so that every one comes after those
+// providing its build dependencies, otherwise keeping found order.
+//
+// Build dependencies are replaced with names of sources providing them.
+// Sources have to be named uniquely.
+func orderSources(sources []source) ([]source, error) {
+	dirs := make(map[string]string)
+	for _, src := range sources {
+		dir, ok := dirs[src.name]
+		if ok {
+			return nil, fmt.Errorf("source package %s found in both %s and %s", src.name, dir, src.dir)
+		}
+		dirs[src.name] = src.dir
+	}
+
+	providers := make(map[string]string)
+	for _, src := range sources {
+		for _, binary := range src.binaries {
+			providers[binary] = src.name
+		}
+	}
+
+	for i := range sources {
+		depends := make([]string, 0)
+		for _, dep := range sources[i].depends {
+			provider, ok := providers[dep]
+			if ok && provider != sources[i].name && !slices.Contains(depends, provider) {
+				depends = append(depends, provider)
+			}
+		}
+		sources[i].depends = depends
+	}
+
+	ordered := make([]source, 0, len(sources))
+	done := make([]string, 0, len(sources))
+
+	for len(ordered) < len(sources) {
+		progress := false
+
+		for _, src := range sources {
+			if slices.Contains(done, src.name) {
+				continue
+			}
+
+			ready := true
+			for _, dep := range src.depends {
+				if !slices.Contains(done, dep) {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				ordered = append(ordered, src)
+				done = append(done, src.name)
+				progress = true
+			}
+		}
+
+		if !progress {
+			return nil, errors.New("circular build dependencies between found source packages")
+		}
+	}
+
+	return ordered, nil
+}
+
+// resetPackageConfig restores flags possibly set by package config
+// of previously built source, unless they were set on command line,
+// to their defaults, possibly from configuration file.
+func resetPackageConfig() error {
+	for _, name := range packageConfigFlags {
+		flag := pflag.Lookup(name)
+		if flag.Changed {
+			continue
+		}
+
+		if value, ok := flag.Value.(pflag.SliceValue); ok {
+			err := value.Replace(userConfig.Flags[name])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := flag.Value.Set(flag.DefValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderSources(t *testing.T) {
+	tests := []struct {
+		name     string
+		sources  []source
+		expected []string
+		err      string
+	}{
+		{
+			name: "dependencies first",
+			sources: []source{
+				{dir: "app", name: "app", binaries: []string{"app"}, depends: []string{"libfoo-dev", "debhelper"}},
+				{dir: "foo", name: "foo", binaries: []string{"libfoo1", "libfoo-dev"}, depends: []string{"libbar-dev"}},
+				{dir: "bar", name: "bar", binaries: []string{"libbar-dev"}},
+			},
+			expected: []string{"bar", "foo", "app"},
+		},
+		{
+			name: "found order kept",
+			sources: []source{
+				{dir: "b", name: "b", binaries: []string{"b"}},
+				{dir: "a", name: "a", binaries: []string{"a"}},
+			},
+			expected: []string{"b", "a"},
+		},
+		{
+			name: "circular",
+			sources: []source{
+				{dir: "a", name: "a", binaries: []string{"a"}, depends: []string{"b"}},
+				{dir: "b", name: "b", binaries: []string{"b"}, depends: []string{"a"}},
+			},
+			err: "circular build dependencies between found source packages",
+		},
+		{
+			name: "duplicate",
+			sources: []source{
+				{dir: "old/foo", name: "foo", binaries: []string{"foo"}},
+				{dir: "new/foo", name: "foo", binaries: []string{"foo"}},
+			},
+			err: "source package foo found in both old/foo and new/foo",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ordered, err := orderSources(test.sources)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			names := make([]string, 0)
+			for _, src := range ordered {
+				names = append(names, src.name)
+			}
+			assert.Equal(t, test.expected, names)
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/dpvpro/deber/pkg/docker"
+	"github.com/dpvpro/deber/pkg/naming"
+	"github.com/dpvpro/deber/pkg/steps"
+	"github.com/spf13/cobra"
+)
+
+// newRulesCommand returns command running debian/rules target
+// in container of package in current directory.
+func newRulesCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rules TARGET",
+		Short: "Run debian/rules target in container",
+		Long: `Run debian/rules target (like clean or override_dh_auto_build)
+in source directory of package container, starting it if needed.
+
+Container has to be kept from earlier build, with --no-remove
+or --stop-after. Failed target's exit status is reported.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withContainer(func(dock docker.Engine, n *naming.Naming) error {
+				err := steps.Start(dock, n)
+				if err != nil {
+					return err
+				}
+
+				err = copySourceIfNeeded(dock, n)
+				if err != nil {
+					return err
+				}
+
+				return steps.Rules(dock, n, args[0])
+			})(cmd, args)
+		},
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/dpvpro/deber/pkg/naming"
+	"github.com/dpvpro/deber/pkg/steps"
+)
+
+// summary is machine readable result of the whole run.
+type summary struct {
+	Success bool           `json:"success"`
+	Builds  []summaryBuild `json:"builds"`
+}
+
+// summaryBuild is result of pipeline for single target.
+type summaryBuild struct {
+	Source    string            `json:"source"`
+	Version   string            `json:"version"`
+	Target    string            `json:"target"`
+	Image     string            `json:"image"`
+	Container string            `json:"container"`
+	Success   bool              `json:"success"`
+	Error     string            `json:"error,omitempty"`
+	Duration  float64           `json:"duration"`
+	Steps     []summaryStep     `json:"steps"`
+	Downloads *steps.Downloads  `json:"downloads,omitempty"`
+	Artifacts []summaryArtifact `json:"artifacts"`
+}
+
+// summaryStep is result of single step.
+type summaryStep struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration"`
+}
+
+// summaryArtifact is archived file.
+type summaryArtifact struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	// summaries are keyed by source and target, so only
+	// the last attempt of retried pipeline is kept
+	summaries     = make(map[string]summaryBuild)
+	summaryMutex  sync.Mutex
+	summaryOutput = "-"
+	// downloads are reported by dependencies step,
+	// keyed the same way as summaries
+	downloads = make(map[string]steps.Downloads)
+)
+
+// recordDownloads stores packages installed for target,
+// so they are included in its summary.
+func recordDownloads(n *naming.Naming, d steps.Downloads) {
+	summaryMutex.Lock()
+	defer summaryMutex.Unlock()
+
+	downloads[n.Source+"/"+n.Target] = d
+}
+
+// recordSummary stores result of pipeline for target,
+// along with checksums of archived files if it succeeded.
+func recordSummary(n *naming.Naming, err error) {
+	build := summaryBuild{
+		Source:    n.Source,
+		Version:   n.Version,
+		Target:    n.Target,
+		Image:     n.Image,
+		Container: n.Container,
+		Success:   err == nil,
+		Steps:     make([]summaryStep, 0),
+		Artifacts: make([]summaryArtifact, 0),
+	}
+	if err != nil {
+		build.Error = err.Error()
+	}
+
+	archived := false
+
+	metricsMutex.Lock()
+	for _, step := range stepOrder {
+		m, ok := metrics[n.Source+"/"+n.Target+"/"+step]
+		if !ok {
+			continue
+		}
+
+		build.Steps = append(build.Steps, summaryStep{
+			Name:     step,
+			Status:   m.status,
+			Duration: m.duration.Seconds(),
+		})
+		archived = archived || (step == stepArchive && m.status == statusDone)
+	}
+	build.Duration = metrics[n.Source+"/"+n.Target+"/"].duration.Seconds()
+	metricsMutex.Unlock()
+
+	if archived {
+		artifacts, _ := hashArtifacts(n.BuildDir)
+		for _, artifact := range artifacts {
+			build.Artifacts = append(build.Artifacts, summaryArtifact{
+				Path:   filepath.Join(n.PackagesVersionDir, artifact.Name),
+				SHA256: artifact.SHA256,
+			})
+		}
+	}
+
+	summaryMutex.Lock()
+	defer summaryMutex.Unlock()
+
+	if d, ok := downloads[n.Source+"/"+n.Target]; ok {
+		build.Downloads = &d
+	}
+
+	summaries[n.Source+"/"+n.Target] = build
+}
+
+// writeSummary writes recorded results as JSON to file,
+// or standard output if path is "-".
+func writeSummary(path string) error {
+	summaryMutex.Lock()
+	defer summaryMutex.Unlock()
+
+	keys := make([]string, 0, len(summaries))
+	for key := range summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	document := summary{
+		Success: true,
+		Builds:  make([]summaryBuild, 0, len(keys)),
+	}
+	for _, key := range keys {
+		document.Builds = append(document.Builds, summaries[key])
+	}
+	document.Success = len(keys) > 0 && !slices.ContainsFunc(document.Builds, func(build summaryBuild) bool {
+		return !build.Success
+	})
+
+	content, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+
+	if path == summaryOutput {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+
+	return os.WriteFile(path, content, 0644)
+}